@@ -0,0 +1,118 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// device selection policies.
+const (
+	roundRobin = "round-robin"
+	leastUsed  = "least-used"
+	random     = "random"
+)
+
+// devicePolicies lists supported device selection policies.
+var devicePolicies = []string{roundRobin, leastUsed, random}
+
+// deviceT is (glob-matched) device file, with its usage counts.
+type deviceT struct {
+	path string
+	// items currently running on device
+	running int
+	// items run on device
+	items uint64
+}
+
+// devicesT is the set of device files available to the backend, from
+// which one is picked for each work item, based on selection policy.
+type devicesT struct {
+	list   []deviceT
+	policy string
+	// next device for round-robin
+	next int
+	// locking for those
+	mutex sync.Mutex
+}
+
+// newDevices returns device set for given file paths, using given
+// selection policy.
+func newDevices(paths []string, policy string) *devicesT {
+	list := make([]deviceT, len(paths))
+	for i, p := range paths {
+		list[i].path = p
+	}
+
+	return &devicesT{list: list, policy: policy}
+}
+
+// validPolicy returns true if given device selection policy is supported.
+func validPolicy(policy string) bool {
+	for _, p := range devicePolicies {
+		if p == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick returns index of the device to use next.
+// Must be called with devices mutex held.
+func (d *devicesT) pick() int {
+	switch d.policy {
+	case leastUsed:
+		// fewest currently running items, then fewest items run,
+		// and then the first one
+		idx := 0
+
+		for i := 1; i < len(d.list); i++ {
+			dev, best := &d.list[i], &d.list[idx]
+			if dev.running < best.running || (dev.running == best.running && dev.items < best.items) {
+				idx = i
+			}
+		}
+
+		return idx
+	case random:
+		return rand.Intn(len(d.list))
+	default:
+		idx := d.next
+		d.next = (d.next + 1) % len(d.list)
+
+		return idx
+	}
+}
+
+// acquire selects device for a work item, and returns its path and
+// index, or empty string and -1 if there are no devices.
+func (d *devicesT) acquire() (string, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.list) == 0 {
+		return "", -1
+	}
+
+	idx := d.pick()
+	dev := &d.list[idx]
+	dev.running++
+	dev.items++
+
+	return dev.path, idx
+}
+
+// release marks work item on given device path (from acquire) done.
+func (d *devicesT) release(file string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i := range d.list {
+		if d.list[i].path == file {
+			d.list[i].running--
+			return
+		}
+	}
+}
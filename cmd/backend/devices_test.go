@@ -0,0 +1,67 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDevicesAcquire(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// whether acquired device is released before next acquire
+		release []bool
+		want    []int
+	}{
+		{"round-robin", roundRobin, []bool{false, false, false, false}, []int{0, 1, 2, 0}},
+		{"round-robin released", roundRobin, []bool{true, true, true, true}, []int{0, 1, 2, 0}},
+		{"least-used", leastUsed, []bool{false, false, false, false}, []int{0, 1, 2, 0}},
+		{"least-used released", leastUsed, []bool{true, true, true, true}, []int{0, 1, 2, 0}},
+		{"least-used running", leastUsed, []bool{false, true, true, true, false}, []int{0, 1, 2, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := newDevices([]string{"card0", "card1", "card2"}, tt.policy)
+
+			got := make([]int, 0, len(tt.want))
+			for _, release := range tt.release {
+				file, idx := devices.acquire()
+				got = append(got, idx)
+
+				if release {
+					devices.release(file)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("acquired devices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevicesRandom(t *testing.T) {
+	devices := newDevices([]string{"card0", "card1", "card2"}, random)
+
+	for i := 0; i < 100; i++ {
+		if file, idx := devices.acquire(); idx < 0 || idx >= 3 || file != devices.list[idx].path {
+			t.Fatalf("acquire() = %s, %d, want one of the devices", file, idx)
+		}
+	}
+
+	total := uint64(0)
+	for _, dev := range devices.list {
+		total += dev.items
+	}
+
+	if total != 100 {
+		t.Fatalf("device item counts total = %d, want 100", total)
+	}
+
+	if file, idx := newDevices(nil, random).acquire(); file != "" || idx != -1 {
+		t.Fatalf("acquire() without devices = %s, %d, want \"\", -1", file, idx)
+	}
+}
@@ -3,9 +3,11 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -16,40 +18,30 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
 )
 
 const (
 	project = "Device Scalability Tester for Kubernetes - backend"
 	version = "v0.1"
 	mapster = "FILENAME"
-	tcpSize = 1024 // max space for a TCP message
 )
 
-var verbose bool
-
-// worker work item request.
-type workReq struct {
-	Queue string // queue name
-}
-
-// work for worker.
-type workItem struct {
-	Error string   // non-empty on errors
-	Args  []string // extra workload arguments
-	Limit float64  // in secs (0=default)
-	Empty bool     // true if error is due to queue being empty
-}
+var (
+	verbose bool
+	msgmax  int // max size for a TCP message
+)
 
-// worker -> frontend -> client return replies.
-type replyT struct {
-	Pod     string  // who did work
-	Node    string  // on which node
-	Device  string  // device mapped to worker, if any
-	Error   string  // non-empty on errors
-	Timeout float64 // >0 = workload timed out
-	Runtime float64 // workload run time, in secs
-	Retcode int     // workload return code
-}
+var (
+	// errEmpty is returned when queue is empty and backoff is disabled.
+	errEmpty = errors.New("queue empty")
+	// errFrontend is returned for frontend error replies.
+	errFrontend = errors.New("frontend returned error")
+	// work context cancel causes.
+	errCanceled = errors.New("canceled by frontend")
+	errShutdown = errors.New("terminated due to backend shutdown")
+)
 
 // getEnv if env var name given, gets the value and if it's non-empty,
 // returns that, otherwise fallback.
@@ -66,11 +58,11 @@ func getEnv(name, fallback string) string {
 	return name
 }
 
-// getFile() returns first file name matching the glob pattern.
+// getFiles() returns file names matching the glob pattern.
 // If no matches are found for non-empty pattern, process is terminated.
-func getFile(glob string) string {
+func getFiles(glob string) []string {
 	if glob == "" {
-		return ""
+		return nil
 	}
 
 	// available file name paths
@@ -79,13 +71,14 @@ func getFile(glob string) string {
 		log.Fatalf("ERROR: no files matching glob pattern '%s'", glob)
 	}
 
-	if len(paths) > 1 {
-		log.Printf("WARN: %d matches for glob pattern '%s'", len(paths), glob)
+	names := make([]string, len(paths))
+	for i, name := range paths {
+		names[i] = path.Base(name)
 	}
 
-	log.Printf("'%s' matches to '%s'", glob, path.Base(paths[0]))
+	log.Printf("'%s' matches to: %v", glob, names)
 
-	return paths[0]
+	return paths
 }
 
 // mapArgs maps "FILENAME" string in argument list to globbed file name.
@@ -106,172 +99,624 @@ func mapArgs(args []string, name string) ([]string, string) {
 	return args, ""
 }
 
-// getWork connects server, send work request, parses work item.  Returns
-// connection and workItem, but when queue is empty, returned connection is nil.
-func getWork(address string, req []byte, backoff bool) (net.Conn, workItem) {
-	conn, err := net.Dial("tcp", address)
+// abortOnDone aborts blocked reads and writes on given connection when
+// given context is done. Returned function stops that, and tells
+// whether connection was aborted.
+func abortOnDone(ctx context.Context, conn net.Conn) func() bool {
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := conn.SetDeadline(time.Now()); err != nil {
+				log.Printf("WARN: aborting frontend connection I/O failed: %v", err)
+			}
+
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-aborted
+	}
+}
+
+// sendRequest sends work request to given connection, and receives work
+// item for it with given connection reader.
+func sendRequest(conn net.Conn, reader *protocol.Reader, req []byte) (protocol.WorkItem, error) {
+	item := protocol.WorkItem{}
+
+	n, err := conn.Write(req)
+	if err == nil && n != len(req) {
+		err = io.ErrShortWrite
+	}
+
 	if err != nil {
-		log.Fatalf("ERROR: connection to '%s' failed: %v", address, err)
+		return item, fmt.Errorf("request send write failed (%d/%d bytes): %w", n, len(req), err)
 	}
 
-	var n int
+	data, err := reader.Receive(&item)
+	if verbose {
+		log.Printf("Received (%d bytes) work item (or error): %v", len(data), string(data))
+	}
 
-	n, err = conn.Write(req)
-	if err != nil || n != len(req) {
-		log.Fatalf("ERROR: request send write failed (%d/%d bytes): %v", n, len(req), err)
+	if err != nil {
+		return item, fmt.Errorf("receiving work item failed: %w", err)
 	}
 
-	buf := make([]byte, tcpSize)
+	return item, nil
+}
+
+// getWork connects server, send work request, parses work item.
+// Connecting and waiting for the item are aborted when given context
+// is done.  Returns connection, reader for its further messages, and
+// work item, but when queue is empty and backoff is enabled, returned
+// connection is nil.
+func getWork(ctx context.Context, address string, req []byte, backoff bool) (net.Conn, *protocol.Reader, protocol.WorkItem, error) {
+	var dialer net.Dialer
 
-	n, err = conn.Read(buf)
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		log.Fatalf("ERROR: request reply read failed: %v", err)
+		return nil, nil, protocol.WorkItem{}, fmt.Errorf("connection to '%s' failed: %w", address, err)
 	}
 
-	if verbose {
-		log.Printf("Received (%d bytes) work item (or error): %v", n, string(buf))
+	reader := protocol.NewReader(conn, msgmax)
+
+	stop := abortOnDone(ctx, conn)
+	item, err := sendRequest(conn, reader, req)
+
+	if stop() {
+		conn.Close()
+		return nil, nil, item, fmt.Errorf("waiting for work item aborted: %w", ctx.Err())
 	}
 
-	item := workItem{}
-	if err = json.Unmarshal(buf[:n], &item); err != nil {
-		log.Fatalf("ERROR: JSON work item unmarshaling failed: %v", err)
+	if err != nil {
+		conn.Close()
+		return nil, nil, item, err
 	}
 
 	if item.Error != "" {
+		conn.Close()
+
 		if item.Empty {
 			if backoff {
-				conn.Close()
-				return nil, item
+				return nil, nil, item, nil
 			}
 
-			log.Printf("Terminating: %s", item.Error)
-			os.Exit(0)
+			return nil, nil, item, fmt.Errorf("%w: %s", errEmpty, item.Error)
 		}
 
-		log.Fatalf("ERROR: server returned error: %s", item.Error)
+		return nil, nil, item, fmt.Errorf("%w: %s", errFrontend, item.Error)
 	}
 
-	return conn, item
+	return conn, reader, item, nil
 }
 
-// runSleep sleeps seconds amount parsed from args, until limit.
-// Parsing the first arg instead of last one, allows backend invocation
-// to override value specified (potentially) by the client requests.
-// Returns retcode, timeout and error description (empty for no error).
-func runSleep(args []string, limit float64) (int, float64, string) {
+// runSleep sleeps seconds amount parsed from args, until limit, or
+// until given context is done. Parsing the first arg instead of last
+// one, allows backend invocation to override value specified
+// (potentially) by the client requests. Returns reply with retcode,
+// timeout, cancel info and error description (empty for no error).
+func runSleep(ctx context.Context, args []string, limit float64) protocol.Reply {
 	if verbose {
 		log.Printf("Run (limit=%.1fs): sleep %v", limit, args)
 	}
 
 	if len(args) == 0 {
-		return 1, 0, "Sleep time (seconds) argument missing"
+		return protocol.Reply{Retcode: 1, Error: "Sleep time (seconds) argument missing"}
 	}
 
 	secs, err := strconv.ParseFloat(args[0], 64)
 	if err != nil {
-		return 1, 0, fmt.Sprintf("invalid sleep time value '%s': %v", args[0], err)
+		return protocol.Reply{Retcode: 1, Error: fmt.Sprintf("invalid sleep time value '%s': %v", args[0], err)}
 	}
 
-	msg := ""
-	retcode := 0
-	timeout := 0.0
+	reply := protocol.Reply{}
 
 	if limit > 0.0 && secs > limit {
-		msg = "Sleep timeout"
-		timeout = limit
+		reply.Error = "Sleep timeout"
+		reply.Timeout = limit
 		secs = limit
 	}
 
-	time.Sleep(time.Duration(uint64(1000*secs)) * time.Millisecond)
+	timer := time.NewTimer(time.Duration(uint64(1000*secs)) * time.Millisecond)
+	defer timer.Stop()
 
-	return retcode, timeout, msg
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		cause := context.Cause(ctx)
+		reply = protocol.Reply{
+			Retcode:  1,
+			Canceled: errors.Is(cause, errCanceled),
+			Error:    fmt.Sprintf("Sleep %v", cause),
+		}
+	}
+
+	return reply
+}
+
+// killGroup sends given signal to all processes in given process group.
+func killGroup(pgid int, sig syscall.Signal) {
+	if verbose {
+		log.Printf("Sending %v to process group %d", sig, pgid)
+	}
+
+	if err := syscall.Kill(-pgid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		log.Printf("WARN: sending %v to process group %d failed: %v", sig, pgid, err)
+	}
 }
 
-// runPath runs given binary with given args using given timelimit.
-// Returns retcode, timeout and error description (empty for no error).
-func runPath(args []string, attr *os.ProcAttr, limit float64) (int, float64, string) {
+// waitResult is workload process wait result.
+type waitResult struct {
+	state *os.ProcessState
+	usage protocol.Usage
+	err   error
+}
+
+// terminate sends SIGTERM to given process group, and if it's still
+// alive after kill delay, SIGKILL. Returns process wait result.
+func terminate(path string, pgid int, done <-chan waitResult, delay float64) waitResult {
+	killGroup(pgid, syscall.SIGTERM)
+
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(time.Duration(uint64(1000*delay)) * time.Millisecond):
+		log.Printf("WARN: '%s' still alive %.1fs after SIGTERM => killing it", path, delay)
+		killGroup(pgid, syscall.SIGKILL)
+
+		return <-done
+	}
+}
+
+// runPath runs given binary with given args in its own process group.
+// If it does not finish within given timelimit, or before given context
+// is done, whole process group is sent SIGTERM, and if it's still alive
+// after kill delay, SIGKILL. Returns reply with retcode, timeout, cancel
+// info, error description (empty for no error) and output tail for
+// failed runs (if output capture is enabled).
+func runPath(ctx context.Context, args []string, opts *workOptions, limit float64) protocol.Reply {
 	if verbose {
 		log.Printf("Run (limit=%.1fs): %v", limit, args)
 	}
 
+	path := args[0]
+	attr := opts.attr
+
+	var (
+		capture *captureT
+		err     error
+	)
+
+	if opts.tail > 0 {
+		attr, capture, err = startCapture(attr, opts.tail)
+		if err != nil {
+			log.Printf("WARN: workload output capture setup failed: %v", err)
+			return protocol.Reply{Retcode: 1, Error: fmt.Sprintf("output capture for %s failed: %v", path, err)}
+		}
+	}
+
+	reply := startPath(ctx, args, attr, limit, opts.delay)
+
+	if capture != nil {
+		if output := capture.finish(outputWait); reply.Retcode != 0 || reply.Error != "" {
+			reply.Output = output
+		}
+	}
+
+	return reply
+}
+
+// startPath starts given binary with given args and process attributes,
+// and waits for it to finish, within given timelimit, for runPath().
+func startPath(ctx context.Context, args []string, attr *os.ProcAttr, limit, delay float64) protocol.Reply {
 	path := args[0]
 	proc, err := os.StartProcess(path, args, attr)
 
 	if err != nil {
-		log.Fatalf("ERROR: starting '%s' failed to: %v", path, err)
+		log.Printf("WARN: starting '%s' failed: %v", path, err)
+		return protocol.Reply{Retcode: 1, Error: fmt.Sprintf("starting %s failed: %v", path, err)}
 	}
 
-	state, err := proc.Wait()
-	if err != nil {
-		log.Fatalf("ERROR: waiting '%s' failed to: %v", path, err)
+	done := make(chan waitResult, 1)
+
+	go func() {
+		done <- waitUsage(proc)
+	}()
+
+	var expired <-chan time.Time
+
+	if limit > 0.0 {
+		timer := time.NewTimer(time.Duration(uint64(1000*limit)) * time.Millisecond)
+		defer timer.Stop()
+
+		expired = timer.C
 	}
 
-	// TODO: implement timeout handling
-	timeout := 0.0
-	retcode := state.ExitCode()
-	msg := ""
+	reply := protocol.Reply{}
 
-	if retcode != 0 {
-		msg = fmt.Sprintf("%s returned error code %d", path, retcode)
+	var (
+		cause  error
+		result waitResult
+	)
+
+	select {
+	case result = <-done:
+	case <-expired:
+		log.Printf("WARN: '%s' exceeded %.1fs limit => terminating its process group", path, limit)
+		reply.Timeout = limit
+		result = terminate(path, proc.Pid, done, delay)
+	case <-ctx.Done():
+		cause = context.Cause(ctx)
+		log.Printf("WARN: '%s' %v => terminating its process group", path, cause)
+		reply.Canceled = errors.Is(cause, errCanceled)
+		result = terminate(path, proc.Pid, done, delay)
 	}
 
-	return retcode, timeout, msg
+	if result.err != nil {
+		log.Printf("WARN: waiting '%s' failed: %v", path, result.err)
+		reply.Retcode = 1
+		reply.Error = fmt.Sprintf("waiting %s failed: %v", path, result.err)
+
+		return reply
+	}
+
+	reply.Retcode = result.state.ExitCode()
+	reply.Usage = result.usage
+
+	if status, ok := result.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		// follow shell convention for signaled processes
+		reply.Retcode = 128 + int(status.Signal())
+	}
+
+	switch {
+	case reply.Timeout > 0.0:
+		reply.Error = fmt.Sprintf("%s timed out after %.1fs (error code %d)", path, reply.Timeout, reply.Retcode)
+	case cause != nil:
+		reply.Error = fmt.Sprintf("%s %v (error code %d)", path, cause, reply.Retcode)
+	case reply.Retcode != 0:
+		reply.Error = fmt.Sprintf("%s returned error code %d", path, reply.Retcode)
+	}
+
+	return reply
 }
 
-// doWork runs specified workload + args with given time limit.
-// return reply struct of how it went.
-func doWork(args []string, attr *os.ProcAttr, deflimit, limit float64) replyT {
-	if limit <= 0.0 || limit > deflimit {
-		limit = deflimit
+// doWork runs specified workload + args with the smaller of backend and
+// (non-zero) client time limit, until it's done or given context is
+// done, and returns reply struct of how it went.
+func doWork(ctx context.Context, args []string, opts *workOptions, limit float64) protocol.Reply {
+	if limit <= 0.0 || (opts.limit > 0.0 && limit > opts.limit) {
+		limit = opts.limit
 	}
 
-	var (
-		msg     string
-		retcode int
-		timeout float64
-	)
+	var reply protocol.Reply
 
 	start := time.Now()
 
 	if args[0] == "sleep" {
-		retcode, timeout, msg = runSleep(args[1:], limit)
+		reply = runSleep(ctx, args[1:], limit)
 	} else {
-		retcode, timeout, msg = runPath(args, attr, limit)
+		reply = runPath(ctx, args, opts, limit)
 	}
 
-	runtime := time.Since(start).Seconds()
+	reply.Runtime = time.Since(start).Seconds()
 
-	log.Printf("%v = %d (%fs)", args, retcode, runtime)
+	if opts.slot > 0 {
+		log.Printf("Slot %d: %v = %d (%fs)", opts.slot, args, reply.Retcode, reply.Runtime)
+	} else {
+		log.Printf("%v = %d (%fs)", args, reply.Retcode, reply.Runtime)
+	}
 
-	reply := replyT{
-		Retcode: retcode,
-		Timeout: timeout,
-		Runtime: runtime,
-		Error:   msg,
+	if verbose {
+		log.Printf("Resource usage: %+v", reply.Usage)
 	}
 
 	return reply
 }
 
-// sendReplyClose marshals + sends reply to given connection and closes it.
-func sendReplyClose(conn net.Conn, reply replyT) {
-	data, err := json.MarshalIndent(reply, "", "\t")
+// watchCancel cancels work context with errCanceled when frontend asks
+// current work item to be canceled, or closes the connection read by
+// given reader. Watching is stopped by connection read deadline.
+func watchCancel(reader *protocol.Reader, cancel context.CancelCauseFunc) {
+	var msg protocol.Cancel
+
+	data, err := reader.Receive(&msg)
+	if verbose {
+		log.Printf("Received (%d bytes) cancel request (or error): %v", len(data), string(data))
+	}
+
 	if err != nil {
-		log.Fatalf("ERROR: reply JSON marshaling failed: %v", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// watching stopped for sending the reply
+			return
+		}
+
+		log.Printf("WARN: frontend connection failed while working => canceling: %v", err)
+		cancel(fmt.Errorf("%w (connection failed: %v)", errCanceled, err))
+
+		return
 	}
 
-	if verbose {
-		log.Printf("Closing reply (%d bytes): %v", len(data), string(data))
+	log.Printf("WARN: frontend canceled work item: %s", msg.Reason)
+	cancel(errCanceled)
+}
+
+// workContext returns context for running work item received from
+// given frontend connection and its reader.  It's canceled when frontend
+// cancels the item, or when given grace period has passed after given
+// (termination signal) context is done.  Returned function stops
+// watching the connection and releases the context, and it needs to be
+// called before sending the reply, as frontend closes the connection
+// after reading it.
+func workContext(sigctx context.Context, conn net.Conn, reader *protocol.Reader, grace time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	watched := make(chan struct{})
+
+	go func() {
+		defer close(watched)
+		watchCancel(reader, cancel)
+	}()
+
+	go func() {
+		select {
+		case <-sigctx.Done():
+			log.Printf("Termination signaled while working => letting workload finish (up to %v)", grace)
+		case <-ctx.Done():
+			return
+		}
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			cancel(errShutdown)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			log.Printf("WARN: stopping frontend connection watch failed: %v", err)
+		}
+
+		<-watched
+		cancel(nil)
+	}
+}
+
+// runItem appends args from given work item (unless ignored) to
+// workload args, maps device file name to them, expands their
+// templates with given data, and runs the result.  Returns reply of
+// how it went.
+func runItem(ctx context.Context, item *protocol.WorkItem, opts *workOptions, data *argDataT) protocol.Reply {
+	// mapping modifies args, so backend ones need to be copied
+	args := append([]string(nil), opts.args...)
+	if !opts.ignore {
+		args = append(args, item.Args...)
+	}
+
+	args, errstr := mapArgs(args, data.Device)
+	if errstr == "" {
+		args, errstr = expandArgs(args, len(opts.args), data)
 	}
 
-	var n int
+	if errstr != "" {
+		return protocol.Reply{Error: errstr, Retcode: 1}
+	}
+
+	return doWork(ctx, args, opts, item.Limit)
+}
+
+// processItem runs given work item received from given frontend
+// connection (and its reader) on a device selected for it, and always
+// sends reply for it.  Returns error if sending the reply fails.
+func processItem(sigctx context.Context, conn net.Conn, reader *protocol.Reader, item *protocol.WorkItem, opts *workOptions) error {
+	ctx, release := workContext(sigctx, conn, reader, opts.grace)
+
+	var (
+		reply protocol.Reply
+		file  string
+	)
 
-	n, err = conn.Write(data)
-	if err != nil || n != len(data) {
-		log.Fatalf("ERROR: request send write failed (%d/%d bytes): %v", n, len(data), err)
+	if err := item.Validate(); err != nil {
+		reply = protocol.Reply{Error: fmt.Sprintf("invalid work item: %v", err), Retcode: 1}
+	} else {
+		data := newArgData(opts, item.ID)
+		reply = runItem(ctx, item, opts, data)
+		opts.devs.release(data.Device)
+		data.cleanup()
+
+		file = data.Device
 	}
+	// add backend info
+	reply.Node, reply.Pod = opts.node, opts.pod
+	// no device, instead of path.Base() "."
+	if file != "" {
+		reply.Device = path.Base(file)
+	}
+
+	release()
 
-	conn.Close()
+	return sendReplyClose(conn, reply)
+}
+
+// backoff sleeps for the part of given backoff time that frontend did not
+// already wait for queue items since given start time, or until given
+// context is done.
+func backoff(ctx context.Context, total float64, start time.Time) {
+	sleep := total - time.Since(start).Seconds()
+	if sleep <= 0 {
+		if verbose {
+			log.Print("Queue still empty after frontend wait")
+		}
+
+		return
+	}
+
+	log.Printf("Queue empty -> sleeping %.1fs", sleep)
+
+	timer := time.NewTimer(time.Duration(uint64(1000*sleep)) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// newSlot returns work options for given work slot, with work request
+// for the slot.  If there's just one slot, its number is zero.
+func newSlot(opts *workOptions, slot int) *workOptions {
+	s := *opts
+	s.slot = slot
+
+	req := opts.wreq
+	req.Slot = slot
+
+	var err error
+
+	// all work item requests from a slot are identical
+	s.req, err = protocol.Encode(req, msgmax)
+	if err != nil {
+		log.Fatalf("ERROR: work request encoding failed: %v", err)
+	}
+
+	if slot > 0 {
+		log.Printf("Slot %d work requests: %v", slot, string(s.req))
+	} else {
+		log.Printf("Work requests are identical (but use separate connections): %v", string(s.req))
+	}
+
+	return &s
+}
+
+// runSlots pulls and processes work items concurrently in configured
+// number of work slots, until given (termination signal) context is
+// done, or there's an error.  Slot finding queue empty (when backoff is
+// disabled) stops just that slot, other errors stop all slots.
+// Returns total number of completed items, and error.
+func runSlots(ctx context.Context, opts *workOptions) (int, error) {
+	if opts.jobs == 1 {
+		return pullWork(ctx, newSlot(opts, 0))
+	}
+
+	type slotResult struct {
+		completed int
+		err       error
+	}
+
+	slotctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan slotResult, opts.jobs)
+
+	for slot := 1; slot <= opts.jobs; slot++ {
+		s := newSlot(opts, slot)
+
+		go func() {
+			completed, err := pullWork(slotctx, s)
+			if err != nil {
+				log.Printf("Slot %d stopped: %v", s.slot, err)
+			}
+
+			results <- slotResult{completed, err}
+		}()
+	}
+
+	total := 0
+
+	var err error
+
+	for i := 0; i < opts.jobs; i++ {
+		result := <-results
+		total += result.completed
+
+		if result.err == nil {
+			continue
+		}
+
+		if !errors.Is(result.err, errEmpty) {
+			cancel()
+		}
+
+		// prefer errors that stop all slots
+		if err == nil || errors.Is(err, errEmpty) {
+			err = result.err
+		}
+	}
+
+	return total, err
+}
+
+// pullWork pulls work items from frontend and processes them, until
+// given (termination signal) context is done, or there's an error.
+// Returns number of completed items, and error.
+func pullWork(ctx context.Context, opts *workOptions) (int, error) {
+	total := opts.inc
+	completed := 0
+
+	for ctx.Err() == nil {
+		start := time.Now()
+
+		conn, reader, item, err := getWork(ctx, opts.addr, opts.req, (opts.inc > 0))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
+			return completed, err
+		}
+
+		if conn == nil {
+			if total > opts.max {
+				total = opts.max
+			}
+
+			if opts.limit > 0.0 && total > opts.limit {
+				total = opts.limit
+			}
+
+			backoff(ctx, total, start)
+
+			total += opts.inc
+
+			continue
+		}
+
+		total = opts.inc
+
+		if err = processItem(ctx, conn, reader, &item, opts); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+
+		completed++
+	}
+
+	return completed, nil
+}
+
+// sendReplyClose sends reply to given connection and closes it.
+func sendReplyClose(conn net.Conn, reply protocol.Reply) error {
+	defer conn.Close()
+
+	reply.Version = protocol.Version
+
+	data, err := protocol.Send(conn, reply, msgmax)
+	if err != nil {
+		return fmt.Errorf("reply send failed: %w", err)
+	}
+
+	if verbose {
+		log.Printf("Closing reply (%d bytes): %v", len(data), string(data))
+	}
+
+	return nil
 }
 
 // getAttr sets workload workdir + output redirection to returned *struct.
@@ -307,26 +752,36 @@ func getAttr(dir string, nullin, nullout bool) *os.ProcAttr {
 		log.Print("stdout/stderr mapped to parent stdout/stderr")
 	}
 
+	// own process group, so that timed out workload can be
+	// terminated along with all of its child processes
 	return &os.ProcAttr{
 		Files: []*os.File{stdin, stdout, stderr},
 		Dir:   dir,
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
 	}
 }
 
 // work for worker.
 type workOptions struct {
-	addr   string       // frontend service address
-	file   string       // device file name
-	node   string       // backend node name
-	pod    string       // backend pod name
-	args   []string     // workload arguments
-	attr   *os.ProcAttr // workload process attributes
-	req    []byte       // workload request data
-	inc    float64      // queue poll backoff time increment
-	max    float64      // queue poll backoff time max
-	limit  float64      // workload runtime limit (secs)
-	ignore bool         // ignore client provided extra workload args
-	once   bool         // test: run workload directly & exit
+	addr   string           // frontend service address
+	node   string           // backend node name
+	pod    string           // backend pod name
+	args   []string         // workload arguments
+	attr   *os.ProcAttr     // workload process attributes
+	req    []byte           // workload request data
+	inc    float64          // queue poll backoff time increment
+	max    float64          // queue poll backoff time max
+	wait   float64          // max time for frontend to wait for queue items
+	limit  float64          // workload runtime limit (secs)
+	delay  float64          // delay between workload SIGTERM and SIGKILL (secs)
+	devs   *devicesT        // device files, one is selected for each work item
+	jobs   int              // number of concurrent work slots
+	slot   int              // work slot number (0=just one slot)
+	wreq   protocol.WorkReq // work request template for slots
+	grace  time.Duration    // max time to let workload run after termination signal
+	tail   int              // workload output tail capture size (bytes)
+	ignore bool             // ignore client provided extra workload args
+	once   bool             // test: run workload directly & exit
 }
 
 func parseOptions() workOptions {
@@ -335,14 +790,26 @@ func parseOptions() workOptions {
 	flag.StringVar(&opts.addr, "faddr", "localhost:9999", "Frontend service address:port for backend work queue")
 	flag.Float64Var(&opts.inc, "backoff", 0, "When queue is empty, instead of exiting, retry again after N*backoff seconds, 0=disabled")
 	flag.Float64Var(&opts.max, "backoff-max", 5, "Maximum backoff value in seconds")
+	flag.Float64Var(&opts.wait, "wait", 0, "When queue is empty, ask frontend to wait up to given seconds for next item, 0=disabled")
 	flag.Float64Var(&opts.limit, "limit", 0, "Backend workload invocation runtime limit in seconds, 0=none")
+	flag.IntVar(&opts.jobs, "jobs", 1, "Number of work items to pull and run concurrently, each in its own work slot")
+
+	var grace float64
+
+	flag.Float64Var(&grace, "grace", 10, "Max time in seconds to let current workload run after termination signal, before terminating it")
+	flag.Float64Var(&opts.delay, "kill-delay", 2, "Delay in seconds between SIGTERM and SIGKILL for a workload exceeding runtime limit")
 	flag.BoolVar(&opts.ignore, "ignore", false, "Ignore extra workload arguments provided in the client request")
+	flag.IntVar(&msgmax, "msg-max", protocol.DefaultMaxSize, "Max size for frontend messages, in bytes")
+	flag.IntVar(&opts.tail, "output-tail", 4, "Return given number of KiB from the end of workload stdout/stderr in replies for failed runs, 0=disabled")
 	flag.BoolVar(&opts.once, "once", false, "Run command directly & exit (for command testing)")
 
-	var dir, glob, name, nenv, penv string
+	var dir, glob, labelstr, name, nenv, penv, policy string
 
 	flag.StringVar(&dir, "dir", "", "Working directory for the backend workload")
-	flag.StringVar(&glob, "glob", "", "Glob pattern for (device) file name(s), match replaces 'FILENAME' in work item args")
+	flag.StringVar(&glob, "glob", "", "Glob pattern for (device) file name(s), selected match replaces 'FILENAME' in work item args")
+	flag.StringVar(&policy, "device-policy", roundRobin,
+		fmt.Sprintf("How device file is selected for each work item from glob matches, one of: %s", strings.Join(devicePolicies, ", ")))
+	flag.StringVar(&labelstr, "labels", "", "Comma separated key=value worker capability labels, matched against client request selectors ('node' label is added automatically)")
 	flag.StringVar(&name, "name", "sleep", "Backend work items queue name")
 	flag.StringVar(&nenv, "node-env", "", "Get reply node name from given variable instead of hostname")
 	flag.StringVar(&penv, "pod-env", "", "Get reply pod name from given variable instead of hostname")
@@ -362,37 +829,85 @@ func parseOptions() workOptions {
 
 	opts.pod = getEnv(penv, host)
 	opts.node = getEnv(nenv, host)
-	opts.file = getFile(glob)
 
-	args, errstr := mapArgs(flag.Args(), opts.file)
-	if errstr != "" {
-		log.Fatalf("ERROR: %s", errstr)
+	if !validPolicy(policy) {
+		log.Fatalf("ERROR: invalid device selection policy '%s', not one of: %s", policy, strings.Join(devicePolicies, ", "))
+	}
+
+	files := getFiles(glob)
+	if len(files) > 1 {
+		log.Printf("Device file is selected for each work item using '%s' policy", policy)
+	}
+
+	opts.devs = newDevices(files, policy)
+
+	labels, err := protocol.ParseLabels(labelstr)
+	if err != nil {
+		log.Fatalf("ERROR: invalid worker labels: %v", err)
+	}
+
+	if _, exists := labels["node"]; !exists {
+		labels["node"] = opts.node
 	}
 
+	// args are mapped separately for each work item, as they
+	// may use different files
+	args := flag.Args()
 	if len(args) == 0 || args[0] == "" || (args[0][0] != '/' && args[0] != "sleep") {
 		log.Fatalf("ERROR: invalid workload, either give its absolute path, or use 'sleep', not: %s", args)
 	}
 
+	if len(files) == 0 {
+		if _, errstr := mapArgs(append([]string(nil), args...), ""); errstr != "" {
+			log.Fatalf("ERROR: %s", errstr)
+		}
+	}
+
+	for _, arg := range args {
+		if _, err = parseArg(arg, true); err != nil {
+			log.Fatalf("ERROR: invalid workload arg '%s': %v", arg, err)
+		}
+	}
+
 	log.Printf("Node '%s' backend pod '%s' workload is: %s", opts.node, opts.pod, args)
 	opts.args = args
 
+	if opts.jobs < 1 {
+		log.Fatalf("ERROR: invalid number of jobs (%d < 1)", opts.jobs)
+	}
+
 	if opts.limit > 0 {
 		log.Printf("With %.1fs run-time limit enforced", opts.limit)
 	}
 
+	if opts.delay < 0 || grace < 0 {
+		log.Fatalf("ERROR: invalid kill delay/grace values (0 <= %.1f, 0 <= %.1f)", opts.delay, grace)
+	}
+
+	opts.grace = time.Duration(uint64(1000*grace)) * time.Millisecond
+
 	if opts.inc < 0 || opts.max < opts.inc {
 		log.Fatalf("ERROR: invalid backoff/-max values (0 <= %.1f < %.1f)", opts.inc, opts.max)
 	}
 
-	log.Printf("Sending '%s' queue work requests to '%s'", name, opts.addr)
+	if opts.wait < 0 {
+		log.Fatalf("ERROR: invalid wait value (0 <= %.1f)", opts.wait)
+	}
 
-	// all work item requests are identical
-	opts.req, err = json.MarshalIndent(workReq{Queue: name}, "", "\t")
-	if err != nil {
-		log.Fatalf("ERROR: work request JSON marshaling failed: %v", err)
+	if msgmax < protocol.MinMaxSize {
+		log.Fatalf("ERROR: too small message size limit (%d < %d)", msgmax, protocol.MinMaxSize)
+	}
+
+	// JSON escaping can grow control characters 6x, and rest
+	// of the reply needs some space too
+	opts.tail *= 1024
+	if opts.tail < 0 || 6*opts.tail > msgmax-protocol.MinMaxSize {
+		log.Fatalf("ERROR: invalid output tail size for %d byte message size limit (0 <= %d <= %d bytes)",
+			msgmax, opts.tail, (msgmax-protocol.MinMaxSize)/6)
 	}
 
-	log.Printf("Work requests are identical (but use separate connections): %v", string(opts.req))
+	log.Printf("Sending '%s' queue work requests to '%s' from %d slot(s), with labels: %v", name, opts.addr, opts.jobs, labels)
+	opts.wreq = protocol.NewWorkReq(name, opts.pod, opts.node, 0, opts.wait, labels)
 
 	// workload workdir + output redirection
 	opts.attr = getAttr(dir, nullin, nullout)
@@ -407,62 +922,28 @@ func main() {
 
 	if opts.once {
 		log.Print("Running command directly (-once)")
-		doWork(opts.args, opts.attr, opts.limit, opts.limit)
+
+		slot := newSlot(&opts, 0)
+		data := newArgData(slot, "once")
+		runItem(context.Background(), &protocol.WorkItem{}, slot, data)
+		data.cleanup()
 
 		return
 	}
 
-	ch := make(chan os.Signal, 1)
 	// catch user and k8s interrupts to exit gracefully
-	signal.Notify(ch, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-
-	total := opts.inc
-	completed := 0
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	for {
-		conn, item := getWork(opts.addr, opts.req, (opts.inc > 0))
-		if conn == nil {
-			if total > opts.max {
-				total = opts.max
-			}
-
-			if opts.limit > 0.0 && total > opts.limit {
-				total = opts.limit
-			}
+	completed, err := runSlots(ctx, &opts)
 
-			log.Printf("Queue empty -> sleeping %.1fs", total)
-			time.Sleep(time.Duration(uint64(1000*total)) * time.Millisecond)
+	stop()
 
-			total += opts.inc
-		} else {
-			total = opts.inc
-			var reply replyT
-
-			if opts.ignore {
-				reply = doWork(opts.args, opts.attr, item.Limit, opts.limit)
-			} else {
-				// need to append mapped args from client request to workload
-				if reqargs, errstr := mapArgs(item.Args, opts.file); errstr == "" {
-					allargs := append(opts.args, reqargs...)
-					reply = doWork(allargs, opts.attr, item.Limit, opts.limit)
-				} else {
-					reply = replyT{Error: errstr}
-				}
-			}
-			// add backend info
-			reply.Node, reply.Pod = opts.node, opts.pod
-			reply.Device = path.Base(opts.file)
-
-			sendReplyClose(conn, reply)
-			completed++
-		}
-
-		select {
-		case sig := <-ch:
-			log.Printf("Got %v signal while completing request %d / waiting next => terminating", sig, completed)
-			return
-		default:
-			break
-		}
+	switch {
+	case errors.Is(err, errEmpty):
+		log.Printf("Terminating after %d requests: %v", completed, err)
+	case err != nil:
+		log.Fatalf("ERROR: %v (after %d requests)", err, completed)
+	default:
+		log.Printf("Got termination signal => terminating after %d requests", completed)
 	}
 }
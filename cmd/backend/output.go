@@ -0,0 +1,148 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how long to wait for workload output to end after workload
+// itself has exited (its detached children may still keep it open).
+const outputWait = time.Second
+
+// tailT keeps the last bytes written to it, up to its size.
+// Both workload stdout and stderr are written to it.
+type tailT struct {
+	buf       []byte
+	size      int
+	truncated bool
+	// locking for those
+	mutex sync.Mutex
+}
+
+// Write appends given data to tail, dropping oldest data
+// that does not fit.
+func (t *tailT) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := len(p)
+	if n >= t.size {
+		t.truncated = t.truncated || n > t.size || len(t.buf) > 0
+		t.buf = append(t.buf[:0], p[n-t.size:]...)
+
+		return n, nil
+	}
+
+	if overflow := len(t.buf) + n - t.size; overflow > 0 {
+		t.truncated = true
+		copy(t.buf, t.buf[overflow:])
+		t.buf = t.buf[:len(t.buf)-overflow]
+	}
+
+	t.buf = append(t.buf, p...)
+
+	return n, nil
+}
+
+// String returns tail content, with "..." prefix if earlier
+// content was dropped.
+func (t *tailT) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.truncated {
+		return "..." + string(t.buf)
+	}
+
+	return string(t.buf)
+}
+
+// captureT captures workload stdout / stderr tail through pipes, while
+// still passing the output also to the files originally specified for
+// them (backend stdout / stderr, or /dev/null).
+type captureT struct {
+	tail    *tailT
+	readers []*os.File
+	writers []*os.File
+	copiers sync.WaitGroup
+}
+
+// startCapture returns copy of given process attributes, with stdout
+// and stderr replaced by pipes, and capture for their output tail of
+// given size.
+func startCapture(attr *os.ProcAttr, size int) (*os.ProcAttr, *captureT, error) {
+	c := &captureT{tail: &tailT{buf: make([]byte, 0, size), size: size}}
+
+	files := append([]*os.File(nil), attr.Files...)
+
+	for i := 1; i <= 2; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			c.finish(outputWait)
+			return nil, nil, err
+		}
+
+		c.readers = append(c.readers, r)
+		c.writers = append(c.writers, w)
+
+		orig := files[i]
+		files[i] = w
+
+		c.copiers.Add(1)
+
+		go func() {
+			defer c.copiers.Done()
+
+			if _, err := io.Copy(io.MultiWriter(c.tail, orig), r); err != nil && verbose {
+				log.Printf("Workload output copy ended: %v", err)
+			}
+		}()
+	}
+
+	captured := *attr
+	captured.Files = files
+
+	return &captured, c, nil
+}
+
+// closeWriters closes backend copies of the pipe write ends, so that
+// pipes end when workload (and its children) have closed theirs.
+func (c *captureT) closeWriters() {
+	for _, w := range c.writers {
+		w.Close()
+	}
+
+	c.writers = nil
+}
+
+// finish waits up to given time for workload output to end, closes
+// the pipes, and returns captured output tail.
+func (c *captureT) finish(wait time.Duration) string {
+	c.closeWriters()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.copiers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(wait):
+		log.Printf("WARN: workload output still open %v after its exit => closing it", wait)
+	}
+
+	for _, r := range c.readers {
+		r.Close()
+	}
+
+	<-done
+
+	return c.tail.String()
+}
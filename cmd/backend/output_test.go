@@ -0,0 +1,41 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+)
+
+func TestTailWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"fits", []string{"ab", "cd"}, "abcd"},
+		{"exact size", []string{"abc", "de"}, "abcde"},
+		{"exact size single write", []string{"abcde"}, "abcde"},
+		{"over size", []string{"abc", "def"}, "...bcdef"},
+		{"over size many writes", []string{"ab", "cd", "ef", "gh", "i"}, "...efghi"},
+		{"over size single write", []string{"abcdefg"}, "...cdefg"},
+		{"full write after data", []string{"a", "bcdef"}, "...bcdef"},
+		{"empty writes", []string{"", "abc", ""}, "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tail := &tailT{buf: make([]byte, 0, 5), size: 5}
+
+			for _, s := range tt.writes {
+				if n, err := tail.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v, want %d, nil", s, n, err, len(s))
+				}
+			}
+
+			if got := tail.String(); got != tt.want {
+				t.Fatalf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
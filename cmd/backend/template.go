@@ -0,0 +1,128 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// errEnv is returned for unset environment variables in workload args.
+var errEnv = errors.New("environment variable not set")
+
+// argFuncs are the functions available in client provided workload
+// arg templates.
+var argFuncs = template.FuncMap{
+	"base": path.Base,
+}
+
+// backendArgFuncs are the functions available in backend workload arg
+// templates. Only those can access backend environment.
+var backendArgFuncs = template.FuncMap{
+	"env":  argEnv,
+	"base": path.Base,
+}
+
+// argEnv returns value of given environment variable, or error if it's not set.
+func argEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: '%s'", errEnv, name)
+	}
+
+	return value, nil
+}
+
+// argDataT provides values for workload arg templates,
+// e.g. "{{.Device}}", "{{.TempDir}}/out" or "{{env "HOME"}}".
+type argDataT struct {
+	Device string // selected device file path
+	Index  int    // selected device index (-1=none)
+	Node   string // backend node name
+	Pod    string // backend pod name
+	ID     string // work item ID
+	Slot   int    // work slot number (0=just one slot)
+	// per-item temporary directory, created on first use
+	tmpdir string
+}
+
+// newArgData returns arg template data for work item with given ID,
+// with a device selected for it.  Device needs to be released, and
+// data cleaned up, after work item is done.
+func newArgData(opts *workOptions, id string) *argDataT {
+	data := &argDataT{Node: opts.node, Pod: opts.pod, ID: id, Slot: opts.slot}
+	data.Device, data.Index = opts.devs.acquire()
+
+	return data
+}
+
+// TempDir returns per-item temporary directory, creating it on first call.
+func (d *argDataT) TempDir() (string, error) {
+	if d.tmpdir == "" {
+		dir, err := os.MkdirTemp("", "work-*")
+		if err != nil {
+			return "", err
+		}
+
+		d.tmpdir = dir
+	}
+
+	return d.tmpdir, nil
+}
+
+// cleanup removes per-item temporary directory, if one was created.
+func (d *argDataT) cleanup() {
+	if d.tmpdir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(d.tmpdir); err != nil {
+		log.Printf("WARN: removing work item temporary directory failed: %v", err)
+	}
+
+	d.tmpdir = ""
+}
+
+// parseArg returns template for given workload arg, or nil if arg
+// does not contain template actions. Backend args can use also
+// backend only template functions.
+func parseArg(arg string, backend bool) (*template.Template, error) {
+	if !strings.Contains(arg, "{{") {
+		return nil, nil
+	}
+
+	funcs := argFuncs
+	if backend {
+		funcs = backendArgFuncs
+	}
+
+	return template.New("arg").Funcs(funcs).Parse(arg)
+}
+
+// expandArgs expands templates in given argument list with given data.
+// Given number of first args are backend ones, rest are from client.
+// Returns modified slice and error string (if expansion failed).
+func expandArgs(args []string, backend int, data *argDataT) ([]string, string) {
+	var buf strings.Builder
+
+	for i, arg := range args {
+		tmpl, err := parseArg(arg, i < backend)
+		if err == nil && tmpl != nil {
+			buf.Reset()
+
+			err = tmpl.Execute(&buf, data)
+			args[i] = buf.String()
+		}
+
+		if err != nil {
+			return nil, fmt.Sprintf("invalid workload arg '%s': %v", arg, err)
+		}
+	}
+
+	return args, ""
+}
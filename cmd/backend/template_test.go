@@ -0,0 +1,51 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"testing"
+)
+
+func TestExpandArgs(t *testing.T) {
+	t.Setenv("TEST_ARG_ENV", "secret")
+
+	data := &argDataT{Device: "/dev/dri/card1", Index: 1, ID: "queue-1"}
+
+	tests := []struct {
+		name    string
+		arg     string
+		backend bool
+		want    string
+		fail    bool
+	}{
+		{"plain", "-v", false, "-v", false},
+		{"data", "{{.ID}}.{{.Index}}", false, "queue-1.1", false},
+		{"base", "{{base .Device}}", false, "card1", false},
+		{"backend env", `{{env "TEST_ARG_ENV"}}`, true, "secret", false},
+		{"client env", `{{env "TEST_ARG_ENV"}}`, false, "", true},
+		{"unset env", `{{env "TEST_ARG_UNSET"}}`, true, "", true},
+		{"invalid", "{{.Missing}}", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := 0
+			if tt.backend {
+				backend = 1
+			}
+
+			args, errstr := expandArgs([]string{tt.arg}, backend, data)
+
+			switch {
+			case tt.fail:
+				if errstr == "" {
+					t.Fatalf("expandArgs(%q) = %q, want failure", tt.arg, args)
+				}
+			case errstr != "":
+				t.Fatalf("expandArgs(%q) unexpected error: %s", tt.arg, errstr)
+			case args[0] != tt.want:
+				t.Fatalf("expandArgs(%q) = %q, want %q", tt.arg, args[0], tt.want)
+			}
+		})
+	}
+}
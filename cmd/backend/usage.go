@@ -0,0 +1,100 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// Linux waitid() ID type for waiting a specific process.
+const pPID = 1
+
+// waitExit waits for given child process to exit, without reaping it,
+// so that its /proc entries are still available.
+func waitExit(pid int) error {
+	// siginfo_t, content is not needed
+	var info [128]byte
+
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid),
+			uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			if errno != 0 {
+				return errno
+			}
+
+			return nil
+		}
+	}
+}
+
+// readIO adds I/O counters of given process, which include its reaped
+// children, from /proc to given usage.
+func readIO(pid int, usage *protocol.Usage) error {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]*uint64{
+		"rchar":       &usage.ReadBytes,
+		"wchar":       &usage.WriteBytes,
+		"read_bytes":  &usage.DiskRead,
+		"write_bytes": &usage.DiskWrite,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if field := fields[name]; found && field != nil {
+			if *field, err = strconv.ParseUint(strings.TrimSpace(value), 10, 64); err != nil {
+				return fmt.Errorf("invalid '%s' value in /proc/%d/io: %w", name, pid, err)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// addRusage adds CPU time, memory and context switch info from given
+// (reaped) process state to given usage.
+func addRusage(state *os.ProcessState, usage *protocol.Usage) {
+	usage.Utime = state.UserTime().Seconds()
+	usage.Stime = state.SystemTime().Seconds()
+
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// in KiB on Linux
+		usage.Maxrss = rusage.Maxrss
+		usage.Nvcsw = rusage.Nvcsw
+		usage.Nivcsw = rusage.Nivcsw
+	}
+}
+
+// waitUsage waits for given process to exit, and returns its exit state
+// and resource usage.
+func waitUsage(proc *os.Process) waitResult {
+	result := waitResult{}
+
+	if err := waitExit(proc.Pid); err != nil {
+		log.Printf("WARN: waiting for process %d exit failed: %v", proc.Pid, err)
+	} else if err = readIO(proc.Pid, &result.usage); err != nil {
+		log.Printf("WARN: reading process %d I/O usage failed: %v", proc.Pid, err)
+	}
+
+	result.state, result.err = proc.Wait()
+	if result.err == nil {
+		addRusage(result.state, &result.usage)
+	}
+
+	return result
+}
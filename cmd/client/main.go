@@ -3,7 +3,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"html"
@@ -19,6 +18,8 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
 )
 
 type outputType int
@@ -27,31 +28,11 @@ const (
 	project = "Device Scalability Tester for Kubernetes - client"
 	version = "v0.1"
 	maxcols = 60
-	tcpSize = 1024 // max space for a TCP message
 	// different output types.
 	plainOutput = outputType(0)
-	htmlOutput  = outputType(0)
+	htmlOutput  = outputType(1)
 )
 
-// client service request.
-type clientReq struct {
-	Queue string   // queue name
-	Args  []string // extra workload arguments
-	Limit float64  // workload run-time limit, in secs (0=default)
-}
-
-// worker -> frontend -> client return replies.
-type replyT struct {
-	Pod      string  // who did work
-	Node     string  // on which node
-	Device   string  // device mapped to worker, if any
-	Error    string  // non-empty on errors
-	Timeout  float64 // >0 = workload timed out
-	Waittime float64 // queue wait time, in secs, added by frontend
-	Runtime  float64 // workload run time, in secs
-	Retcode  int     // workload return code
-}
-
 type replyStatT struct {
 	success, failure uint64
 }
@@ -62,12 +43,23 @@ type timeStatT struct {
 	min, max, total float64
 }
 
+// workload resource usage totals for successful replies
+// which included usage info.
+type usageStatT struct {
+	count   uint64
+	runtime float64
+	// Maxrss is max, rest are totals
+	usage protocol.Usage
+}
+
 // metrics for generating per-node histograms.
 type nodeStatT struct {
-	device  map[string]uint64 // per dev replies
-	pod     map[string]uint64 // per pod replies
-	error   map[string]uint64 // received errors
-	runtime []float64         // run times for all replies
+	device  map[string]uint64      // per dev replies
+	usage   map[string]*usageStatT // per dev resource usage
+	pod     map[string]uint64      // per pod replies
+	error   map[string]uint64      // received errors
+	output  map[string]string      // latest workload output tail for each error
+	runtime []float64              // run times for all replies
 	reply   replyStatT
 }
 
@@ -98,6 +90,7 @@ type statsT struct {
 var (
 	stats   statsT // request statistics
 	verbose bool   // verbose messaging
+	msgmax  int    // max size for a TCP message
 	// set request parallelization: 0 <= x <= reqmax.
 	parallel = make(chan int, 1)
 )
@@ -184,8 +177,9 @@ func printNodeHistogram(w io.Writer, name string, total uint64, mapping map[stri
 }
 
 // printNodeErrors prints count-sorted "count: string" list
-// (when percentage does not matter and strings are too long for histogram).
-func printNodeErrors(w io.Writer, mapping map[string]uint64, output outputType) {
+// (when percentage does not matter and strings are too long for histogram),
+// with latest workload output tail for each error, if there's one.
+func printNodeErrors(w io.Writer, mapping map[string]uint64, tails map[string]string, output outputType) {
 	if len(mapping) == 0 {
 		return
 	}
@@ -194,11 +188,61 @@ func printNodeErrors(w io.Writer, mapping map[string]uint64, output outputType)
 
 	errors := sortByCount(mapping)
 	for _, err := range errors {
-		if output == plainOutput {
-			fmt.Fprintf(w, "- %d: %s\n", err.count, err.name)
-		} else {
-			fmt.Fprintf(w, "- %d: %s\n", err.count, html.EscapeString(err.name))
+		name, tail := err.name, tails[err.name]
+		if output != plainOutput {
+			name, tail = html.EscapeString(name), html.EscapeString(tail)
+		}
+
+		fmt.Fprintf(w, "- %d: %s\n", err.count, name)
+
+		if tail == "" {
+			continue
+		}
+
+		fmt.Fprint(w, "  Latest workload output:\n")
+
+		for _, line := range strings.Split(strings.TrimRight(tail, "\n"), "\n") {
+			fmt.Fprintf(w, "  | %s\n", line)
+		}
+	}
+}
+
+// printNodeUsage prints per-device workload resource usage averages.
+// CPU utilization tells whether device workload is bottlenecked by CPU.
+func printNodeUsage(w io.Writer, usage map[string]*usageStatT) {
+	if len(usage) == 0 {
+		return
+	}
+
+	const mib = 1024 * 1024
+
+	fmt.Fprint(w, "\nDevice workload resource usage (averages per successful request):\n")
+
+	devs := make([]string, 0, len(usage))
+	for dev := range usage {
+		devs = append(devs, dev)
+	}
+
+	sort.Strings(devs)
+
+	for _, dev := range devs {
+		stat := usage[dev]
+		n := float64(stat.count)
+		u := &stat.usage
+
+		cpu := u.Utime + u.Stime
+		utilization := 0.0
+
+		if stat.runtime > 0 {
+			utilization = 100 * cpu / stat.runtime
 		}
+
+		fmt.Fprintf(w, "- %s (%d requests):\n", dev, stat.count)
+		fmt.Fprintf(w, "  CPU: %.3fs user + %.3fs system = %.1f%% of run-time\n", u.Utime/n, u.Stime/n, utilization)
+		fmt.Fprintf(w, "  Max RSS: %.1f MiB\n", float64(u.Maxrss)/1024)
+		fmt.Fprintf(w, "  Context switches: %.1f voluntary, %.1f involuntary\n", float64(u.Nvcsw)/n, float64(u.Nivcsw)/n)
+		fmt.Fprintf(w, "  I/O: %.2f MiB read, %.2f MiB written (storage: %.2f MiB read, %.2f MiB written)\n",
+			float64(u.ReadBytes)/n/mib, float64(u.WriteBytes)/n/mib, float64(u.DiskRead)/n/mib, float64(u.DiskWrite)/n/mib)
 	}
 }
 
@@ -252,7 +296,8 @@ func printNodeStats(w io.Writer, output outputType) {
 		node := stats.node[name]
 		printHeader(w, fmt.Sprintf("Node: %s", name))
 		printNodeHistogram(w, "Device", node.reply.success, node.device)
-		printNodeErrors(w, node.error, output)
+		printNodeUsage(w, node.usage)
+		printNodeErrors(w, node.error, node.output, output)
 	}
 }
 
@@ -499,6 +544,40 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// addUsage adds given reply resource usage to given node device
+// statistics, if reply has usage info.  Must be called with
+// stats.mutex held.
+func addUsage(node *nodeStatT, dev string, reply *protocol.Reply) {
+	u := &reply.Usage
+	if u.Utime == 0 && u.Stime == 0 && u.Maxrss == 0 {
+		// e.g. builtin sleep
+		return
+	}
+
+	stat, exists := node.usage[dev]
+	if !exists {
+		stat = &usageStatT{}
+		node.usage[dev] = stat
+	}
+
+	stat.count++
+	stat.runtime += reply.Runtime
+
+	total := &stat.usage
+	total.Utime += u.Utime
+	total.Stime += u.Stime
+	total.Nvcsw += u.Nvcsw
+	total.Nivcsw += u.Nivcsw
+	total.ReadBytes += u.ReadBytes
+	total.WriteBytes += u.WriteBytes
+	total.DiskRead += u.DiskRead
+	total.DiskWrite += u.DiskWrite
+
+	if u.Maxrss > total.Maxrss {
+		total.Maxrss = u.Maxrss
+	}
+}
+
 // getStatsNode adds given node to global stats, if one is missing,
 // and returns pointer to it. Must be called with stats.mutex held.
 func getStatsNode(name string) *nodeStatT {
@@ -508,6 +587,8 @@ func getStatsNode(name string) *nodeStatT {
 			device:  make(map[string]uint64),
 			pod:     make(map[string]uint64),
 			error:   make(map[string]uint64),
+			output:  make(map[string]string),
+			usage:   make(map[string]*usageStatT),
 		}
 	}
 
@@ -515,7 +596,7 @@ func getStatsNode(name string) *nodeStatT {
 }
 
 // statsFailure adds reply failure info to statistics.
-func statsFailure(reply replyT) {
+func statsFailure(reply protocol.Reply) {
 	stats.mutex.Lock()
 	defer stats.mutex.Unlock()
 
@@ -528,6 +609,10 @@ func statsFailure(reply replyT) {
 		// there are valid reasons to have <> chars in it
 		node.error[reply.Error]++
 		node.reply.failure++
+
+		if reply.Output != "" {
+			node.output[reply.Error] = reply.Output
+		}
 	}
 }
 
@@ -546,7 +631,7 @@ func updateTime(t *timeStatT, secs float64) {
 
 // statsSuccess adds reply success info to statistics.
 // Timings info is updated only on success.
-func statsSuccess(reply replyT, commtime float64) {
+func statsSuccess(reply protocol.Reply, commtime float64) {
 	stats.mutex.Lock()
 	defer stats.mutex.Unlock()
 
@@ -564,6 +649,8 @@ func statsSuccess(reply replyT, commtime float64) {
 	dev := html.EscapeString(reply.Device)
 	node.device[dev]++
 
+	addUsage(node, dev, &reply)
+
 	pod := html.EscapeString(reply.Pod)
 	node.pod[pod]++
 }
@@ -596,20 +683,15 @@ func doRequest(conn net.Conn, req []byte) string {
 		return fmt.Sprintf("request send write failed (%d/%d bytes): %v", n, len(req), err)
 	}
 
-	buf := make([]byte, tcpSize)
-
-	n, err = conn.Read(buf)
-	if err != nil {
-		return fmt.Sprintf("request reply read failed: %v", err)
-	}
+	reply := protocol.Reply{}
 
+	data, err := protocol.Receive(conn, &reply, msgmax)
 	if verbose {
-		log.Printf("Received (%d bytes) reply (or error): %v", n, string(buf))
+		log.Printf("Received (%d bytes) reply (or error): %v", len(data), string(data))
 	}
 
-	reply := replyT{}
-	if err = json.Unmarshal(buf[:n], &reply); err != nil {
-		return fmt.Sprintf("JSON replyT unmarshaling failed: %v", err)
+	if err != nil {
+		return fmt.Sprintf("request reply receive failed: %v", err)
 	}
 
 	if reply.Error != "" {
@@ -726,7 +808,9 @@ func doParallelRequests(faddr string, data []byte, reqnow, reqmax int) {
 func main() {
 	var (
 		reqnow, reqmax     int
+		priority           int
 		caddr, faddr, name string
+		selector           string
 		limit              float64
 	)
 
@@ -734,7 +818,10 @@ func main() {
 	flag.StringVar(&caddr, "caddr", "localhost:9996", "Client query parallelization control + statistics reset / output")
 	flag.StringVar(&faddr, "faddr", "localhost:9997", "Frontend service address:port for client requests")
 	flag.Float64Var(&limit, "limit", 0.0, "backend runtime limit in seconds, 0=none")
+	flag.IntVar(&msgmax, "msg-max", protocol.DefaultMaxSize, "Max size for frontend messages, in bytes")
 	flag.StringVar(&name, "name", "sleep", "Service request queue name (client args are set to request as-is)")
+	flag.StringVar(&selector, "selector", "", "Comma separated worker label requirements for requests (key=value, key!=value, key>=N, key<=N, key, !key)")
+	flag.IntVar(&priority, "priority", 0, "Request priority, added to queue priority (higher is served first)")
 	flag.IntVar(&reqmax, "req-max", 2, "Maximum number of parallel requests that can be specified at runtime")
 	flag.IntVar(&reqnow, "req-now", 1, "Initial number of parallel requests")
 	flag.BoolVar(&verbose, "verbose", false, "Log all messages")
@@ -744,15 +831,27 @@ func main() {
 		log.Fatalf("Invalid parallelization: 0 <= reqnow (%d) <= reqmax (%d) <= 512", reqnow, reqmax)
 	}
 
-	req := clientReq{
-		Queue: name,
-		Args:  flag.Args(),
-		Limit: limit,
+	if msgmax < protocol.MinMaxSize {
+		log.Fatalf("ERROR: too small message size limit (%d < %d)", msgmax, protocol.MinMaxSize)
+	}
+
+	var requirements []string
+	if selector != "" {
+		requirements = strings.Split(selector, ",")
+	}
+
+	req := protocol.NewClientReq(name, flag.Args(), limit, priority, requirements)
+	if err := req.Validate(); err != nil {
+		log.Fatalf("ERROR: invalid client request: %v", err)
+	}
+
+	if _, err := protocol.ParseSelector(req.Selector); err != nil {
+		log.Fatalf("ERROR: invalid client request: %v", err)
 	}
 
-	data, err := json.MarshalIndent(req, "", "\t")
+	data, err := protocol.Encode(req, msgmax)
 	if err != nil {
-		log.Fatalf("ERROR: client request JSON marshaling failed: %v", err)
+		log.Fatalf("ERROR: client request encoding failed: %v", err)
 	}
 
 	log.Printf("Sending following requests to '%s' from %d parallel threads: %v", faddr, reqnow, string(data))
@@ -0,0 +1,51 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintNodeErrors(t *testing.T) {
+	const (
+		desc = "<b>failed</b>"
+		tail = "<script>alert(1)</script>\n"
+	)
+
+	errs := map[string]uint64{desc: 2}
+	tails := map[string]string{desc: tail}
+
+	tests := []struct {
+		name   string
+		output outputType
+		want   []string
+		absent []string
+	}{
+		{"plain", plainOutput, []string{"- 2: <b>failed</b>", "  | <script>alert(1)</script>"}, nil},
+		{"html", htmlOutput,
+			[]string{"- 2: &lt;b&gt;failed&lt;/b&gt;", "  | &lt;script&gt;alert(1)&lt;/script&gt;"},
+			[]string{"<script>", "<b>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+
+			printNodeErrors(&buf, errs, tails, tt.output)
+			out := buf.String()
+
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Fatalf("output missing %q:\n%s", s, out)
+				}
+			}
+
+			for _, s := range tt.absent {
+				if strings.Contains(out, s) {
+					t.Fatalf("output contains unescaped %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
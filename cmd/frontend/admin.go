@@ -0,0 +1,352 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminURL    = "/queues"
+	shutdownURL = "/shutdown"
+)
+
+var (
+	errQueueName   = errors.New("invalid queue name")
+	errQueueExists = errors.New("queue already exists")
+	errQueueNone   = errors.New("unknown queue")
+	// unsupported method / path combination
+	errAdminRequest = errors.New("unsupported admin request")
+)
+
+// admin actions for changing queue state, and their descriptions.
+var adminStates = map[string]string{
+	"pause":  "paused",
+	"resume": "resumed",
+	"drain":  "set draining",
+}
+
+// queueInfoT is queue info provided by the admin API listing.
+type queueInfoT struct {
+	Name       string
+	Waiting    int
+	Running    int
+	Idle       int
+	Paused     bool
+	Draining   bool
+	Scheduling string
+}
+
+// lookup returns named queue, or nil if there's no such queue.
+func (queues *queuesT) lookup(name string) *queueT {
+	queues.mapsMutex.RLock()
+	defer queues.mapsMutex.RUnlock()
+
+	return queues.maps[name]
+}
+
+// list returns current queues, sorted by name.
+func (queues *queuesT) list() []*queueT {
+	queues.mapsMutex.RLock()
+
+	list := make([]*queueT, 0, len(queues.maps))
+	for _, queue := range queues.maps {
+		list = append(list, queue)
+	}
+
+	queues.mapsMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+
+	return list
+}
+
+// checkName returns error if given queue name is not valid.
+func checkName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: '%s'", errQueueName, name)
+	}
+
+	return nil
+}
+
+// create adds new queue with given name and policy, using default
+// queue settings for the rest.
+func (queues *queuesT) create(name string, policy *policyT) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+
+	settings := &queues.settings
+	queue := &queueT{
+		name:    name,
+		lease:   settings.lease,
+		wait:    settings.wait,
+		retries: settings.retries,
+		policy:  *policy,
+		served:  make(map[string]uint64),
+		// histograms share the bucket bounds
+		waithist:  newHistogram(settings.bounds),
+		runhist:   newHistogram(settings.bounds),
+		totalhist: newHistogram(settings.bounds),
+		priohist:  make(map[int]*histogramT),
+	}
+
+	queues.mapsMutex.Lock()
+	defer queues.mapsMutex.Unlock()
+
+	if queues.stopping {
+		return errShutdown
+	}
+
+	if _, exists := queues.maps[name]; exists {
+		return fmt.Errorf("%w: '%s'", errQueueExists, name)
+	}
+
+	queues.maps[name] = queue
+
+	return nil
+}
+
+// remove removes named queue, and returns an error to all clients
+// whose items are still waiting in it. Items already being processed
+// by workers are completed normally.
+func (queues *queuesT) remove(name string) error {
+	queues.mapsMutex.Lock()
+
+	queue, exists := queues.maps[name]
+	if exists {
+		delete(queues.maps, name)
+	}
+
+	queues.mapsMutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("%w: '%s'", errQueueNone, name)
+	}
+
+	queue.mutex.Lock()
+	queue.deleted = true
+	queue.releaseWaiters()
+	items := queue.items.clear()
+	queue.mutex.Unlock()
+
+	for _, item := range items {
+		errorReplyClose(item.client, fmt.Sprintf("'%s' queue was deleted", name))
+	}
+
+	if len(items) > 0 {
+		log.Printf("WARN: discarded %d requests from deleted '%s' queue", len(items), name)
+	}
+
+	return nil
+}
+
+// setState pauses / resumes / drains named queue, based on given action.
+func (queues *queuesT) setState(name, action string) error {
+	queue := queues.lookup(name)
+	if queue == nil {
+		return fmt.Errorf("%w: '%s'", errQueueNone, name)
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	switch action {
+	case "pause":
+		queue.paused = true
+	case "resume":
+		queue.paused = false
+		queue.draining = false
+		// hand items to workers waiting for resume
+		queue.dispatch()
+	case "drain":
+		queue.draining = true
+	}
+
+	return nil
+}
+
+// info returns admin API info for all queues.
+func (queues *queuesT) info() []queueInfoT {
+	list := queues.list()
+	infos := make([]queueInfoT, 0, len(list))
+
+	for _, queue := range list {
+		queue.mutex.Lock()
+		infos = append(infos, queueInfoT{
+			Name:       queue.name,
+			Waiting:    queue.items.len(),
+			Running:    queue.running,
+			Idle:       len(queue.waiters),
+			Paused:     queue.paused,
+			Draining:   queue.draining,
+			Scheduling: queue.policy.Scheduling,
+		})
+		queue.mutex.Unlock()
+	}
+
+	return infos
+}
+
+// adminStatus returns HTTP status code matching given admin error.
+func adminStatus(err error) int {
+	switch {
+	case errors.Is(err, errQueueNone):
+		return http.StatusNotFound
+	case errors.Is(err, errQueueExists):
+		return http.StatusConflict
+	case errors.Is(err, errShutdown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// adminReply writes given admin request reply message with given status.
+func adminReply(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+
+	if _, err := fmt.Fprintln(w, msg); err != nil {
+		log.Printf("WARN: admin reply write failed: %v", err)
+	}
+}
+
+// adminList replies with JSON list of queues.
+func (queues *queuesT) adminList(w http.ResponseWriter) {
+	data, err := json.MarshalIndent(queues.info(), "", "\t")
+	if err != nil {
+		log.Printf("WARN: queue list JSON marshaling failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(data); err != nil {
+		log.Printf("WARN: queue list write failed: %v", err)
+	}
+}
+
+// adminAction performs given admin action for named queue, and
+// returns error, or message describing what was done.
+func (queues *queuesT) adminAction(method, name, action string) (string, error) {
+	var err error
+
+	switch {
+	case method == http.MethodPost && action == "":
+		err = queues.create(name, &queues.settings.policy)
+		action = "created"
+	case method == http.MethodDelete && action == "":
+		err = queues.remove(name)
+		action = "deleted"
+	case method == http.MethodPost && adminStates[action] != "":
+		err = queues.setState(name, action)
+		action = adminStates[action]
+	default:
+		return "", errAdminRequest
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("'%s' queue %s", name, action), nil
+}
+
+// admin handles queue admin requests:
+// - GET /queues: list queues
+// - POST /queues/<name>: create queue
+// - DELETE /queues/<name>: delete queue
+// - POST /queues/<name>/<pause|resume|drain>: change queue state.
+func (queues *queuesT) admin(w http.ResponseWriter, r *http.Request) {
+	if verbose {
+		log.Printf("admin %s request for '%s' from '%s'", r.Method, r.URL.Path, r.RemoteAddr)
+	}
+
+	if r.URL.Path == adminURL {
+		if status := requestCheck(r, adminURL); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		queues.adminList(w)
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, adminURL+"/")
+	name, action, _ := strings.Cut(path, "/")
+
+	msg, err := queues.adminAction(r.Method, name, action)
+	if err != nil {
+		if errors.Is(err, errAdminRequest) {
+			adminReply(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v: %s %s", err, r.Method, r.URL.Path))
+		} else {
+			adminReply(w, adminStatus(err), err.Error())
+		}
+
+		return
+	}
+
+	log.Printf("Admin request from '%s': %s", r.RemoteAddr, msg)
+	adminReply(w, http.StatusOK, msg)
+}
+
+// adminShutdown handles frontend shutdown request (POST /shutdown),
+// which drains all queues and terminates the frontend.
+func (queues *queuesT) adminShutdown(w http.ResponseWriter, r *http.Request) {
+	if verbose {
+		log.Printf("admin %s request for '%s' from '%s'", r.Method, r.URL.Path, r.RemoteAddr)
+	}
+
+	if r.Method != http.MethodPost {
+		adminReply(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v: %s %s", errAdminRequest, r.Method, r.URL.Path))
+		return
+	}
+
+	if !queues.startShutdown() {
+		adminReply(w, http.StatusServiceUnavailable, fmt.Sprintf("%v already", errShutdown))
+		return
+	}
+
+	log.Printf("Admin request from '%s': shutting down", r.RemoteAddr)
+	adminReply(w, http.StatusOK, fmt.Sprintf("Frontend shutting down, waiting up to %v for running items", queues.settings.grace))
+
+	// make sure reply gets out before frontend exits
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	go queues.shutdown()
+}
+
+// listenAdmin serves queue admin and shutdown requests on given address.
+func listenAdmin(addr string, queues *queuesT) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminURL, queues.admin)
+	mux.HandleFunc(adminURL+"/", queues.admin)
+	mux.HandleFunc(shutdownURL, queues.adminShutdown)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadTimeout:       time.Second,
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    4096,
+	}
+
+	log.Printf("Listening queue admin requests on %s%s, and shutdown requests on %s%s", addr, adminURL, addr, shutdownURL)
+	log.Fatal(server.ListenAndServe())
+}
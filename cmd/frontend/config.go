@@ -0,0 +1,286 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+var (
+	errPolicyValue = errors.New("invalid queue policy value")
+	errLimitMax    = errors.New("limit exceeds queue max limit")
+	errArgPattern  = errors.New("argument not matching allowed patterns")
+)
+
+// policyT is queue policy, settable from config file.
+type policyT struct {
+	// max items waiting in queue (0=unlimited)
+	MaxLength int `yaml:"max-length"`
+	// max approximate memory usage of waiting items, in bytes (0=unlimited)
+	MaxBytes int `yaml:"max-bytes"`
+	// max items being processed by workers (0=unlimited)
+	MaxRunning int `yaml:"max-running"`
+	// max time item can wait in queue, in secs (0=unlimited)
+	MaxQueueWait float64 `yaml:"max-queue-wait"`
+	// run-time limit for requests not specifying one (0=max limit),
+	// and max limit requests can specify, in secs (0=backend default)
+	DefaultLimit float64 `yaml:"default-limit"`
+	MaxLimit     float64 `yaml:"max-limit"`
+	// regexps, which each request arg needs to match fully (empty=any)
+	AllowedArgs []string `yaml:"allowed-args"`
+	// priority for queue items, added to request priority,
+	// higher ones are served first
+	Priority int `yaml:"priority"`
+	// secs after which waiting item priority is raised by one (0=never)
+	Ageing float64 `yaml:"ageing"`
+	// how items with same priority are scheduled
+	Scheduling string `yaml:"scheduling"`
+	// compiled AllowedArgs and Scheduling
+	patterns  []*regexp.Regexp
+	scheduler schedulerT
+}
+
+// configT is frontend config file content.
+type configT struct {
+	// queue policies, by queue name
+	Queues map[string]yaml.Node `yaml:"queues"`
+}
+
+// compile validates policy values, and compiles its arg patterns
+// and scheduling policy.
+func (p *policyT) compile() error {
+	if p.MaxLength < 0 || p.MaxBytes < 0 || p.MaxRunning < 0 || p.MaxQueueWait < 0 || p.DefaultLimit < 0 || p.MaxLimit < 0 || p.Ageing < 0 {
+		return fmt.Errorf("%w: negative value", errPolicyValue)
+	}
+
+	if p.MaxLimit > 0 && p.DefaultLimit > p.MaxLimit {
+		return fmt.Errorf("%w: default-limit %.1f not within max-limit %.1f", errPolicyValue, p.DefaultLimit, p.MaxLimit)
+	}
+
+	scheduler, err := getScheduler(p.Scheduling)
+	if err != nil {
+		return err
+	}
+
+	p.scheduler = scheduler
+	p.patterns = make([]*regexp.Regexp, 0, len(p.AllowedArgs))
+
+	for _, pattern := range p.AllowedArgs {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("%w: allowed-args pattern '%s': %v", errPolicyValue, pattern, err)
+		}
+
+		p.patterns = append(p.patterns, re)
+	}
+
+	return nil
+}
+
+// check checks that given client request is allowed by the policy,
+// and sets default limit for it if needed.
+func (p *policyT) check(req *protocol.ClientReq) error {
+	if req.Limit == 0 {
+		req.Limit = p.DefaultLimit
+		if req.Limit == 0 {
+			req.Limit = p.MaxLimit
+		}
+	}
+
+	if p.MaxLimit > 0 && req.Limit > p.MaxLimit {
+		return fmt.Errorf("%w: %.1f > %.1f", errLimitMax, req.Limit, p.MaxLimit)
+	}
+
+	if len(p.patterns) == 0 {
+		return nil
+	}
+
+	for _, arg := range req.Args {
+		matched := false
+
+		for _, re := range p.patterns {
+			if re.MatchString(arg) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("%w: '%s'", errArgPattern, arg)
+		}
+	}
+
+	return nil
+}
+
+// decodeStrict decodes given YAML (or JSON) data to given struct,
+// failing on unknown (e.g. misspelled) keys.
+func decodeStrict(data []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	// empty document leaves struct as-is
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// decodePolicy decodes given queue policy node over given policy,
+// failing on unknown policy keys.
+func decodePolicy(node *yaml.Node, policy *policyT) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("re-encoding policy failed: %w", err)
+	}
+
+	return decodeStrict(data, policy)
+}
+
+// parseConfig reads and validates given YAML (or JSON) config file.
+// Queue policy values missing from it are taken from given defaults.
+// Returns queue policies by queue name.
+func parseConfig(path string, defaults *policyT) (map[string]policyT, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config failed: %w", err)
+	}
+
+	var config configT
+	if err = decodeStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing config '%s' failed: %w", path, err)
+	}
+
+	policies := make(map[string]policyT, len(config.Queues))
+
+	for name, node := range config.Queues {
+		if err = checkName(name); err != nil {
+			return nil, err
+		}
+
+		policy := *defaults
+		if err = decodePolicy(&node, &policy); err != nil {
+			return nil, fmt.Errorf("parsing '%s' queue policy failed: %w", name, err)
+		}
+
+		if err = policy.compile(); err != nil {
+			return nil, fmt.Errorf("'%s' queue: %w", name, err)
+		}
+
+		policies[name] = policy
+	}
+
+	return policies, nil
+}
+
+// loadConfig (re-)loads queue policies from given config file. New
+// queues are created, and policies of existing ones updated. Queues
+// created from earlier version of config, but not in current one,
+// are deleted. Queues created otherwise (from command line or admin
+// API) are not. On error, existing queues are not changed.
+func (queues *queuesT) loadConfig(path string) error {
+	policies, err := parseConfig(path, &queues.settings.policy)
+	if err != nil {
+		return err
+	}
+
+	for name := range queues.configured {
+		if _, exists := policies[name]; exists {
+			continue
+		}
+
+		if err = queues.remove(name); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+
+		delete(queues.configured, name)
+	}
+
+	for name := range policies {
+		policy := policies[name]
+
+		if queue := queues.lookup(name); queue != nil {
+			queue.setPolicy(&policy)
+			continue
+		}
+
+		if err = queues.create(name, &policy); err != nil {
+			log.Printf("WARN: %v", err)
+			continue
+		}
+
+		queues.configured[name] = true
+	}
+
+	log.Printf("Loaded %d queue policies from '%s'", len(policies), path)
+
+	return nil
+}
+
+// setPolicy updates queue policy.
+func (queue *queueT) setPolicy(policy *policyT) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.policy = *policy
+	// new policy may allow more items to run
+	queue.dispatch()
+}
+
+// expire removes items that have waited in the queue longer than
+// queue policy allows, and returns an error to their clients (in
+// the background, as queue.mutex is held).
+// Must be called with queue.mutex held.
+func (queue *queueT) expire(now time.Time) {
+	if queue.policy.MaxQueueWait <= 0 || queue.items.len() == 0 {
+		return
+	}
+
+	maxwait := queue.policy.MaxQueueWait
+
+	var rejects []rejectT
+
+	queue.items.filter(func(item *queueItem) bool {
+		wait := now.Sub(item.added).Seconds()
+		if wait <= maxwait {
+			return true
+		}
+
+		msg := fmt.Sprintf("Request waited %.1fs in '%s' queue, max allowed is %.1fs", wait, queue.name, maxwait)
+		rejects = append(rejects, rejectT{item.client, msg})
+		queue.expired++
+
+		return false
+	})
+
+	if len(rejects) > 0 {
+		go sendRejects(rejects)
+	}
+}
+
+// expireItems removes expired items from all queues, at given interval.
+func (queues *queuesT) expireItems(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		now := time.Now()
+
+		for _, queue := range queues.list() {
+			queue.mutex.Lock()
+			queue.expire(now)
+			queue.mutex.Unlock()
+		}
+	}
+}
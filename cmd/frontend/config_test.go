@@ -0,0 +1,214 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// writeConfig writes given content to a config file in test temp dir,
+// and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config failed: %v", err)
+	}
+
+	return path
+}
+
+func TestPolicyCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy policyT
+		err    error
+	}{
+		{"default", policyT{Scheduling: "fifo"}, nil},
+		{"limits", policyT{Scheduling: "edf", DefaultLimit: 5, MaxLimit: 10, AllowedArgs: []string{"-v", "[0-9]+"}}, nil},
+		{"negative", policyT{Scheduling: "fifo", MaxRunning: -1}, errPolicyValue},
+		{"default over max", policyT{Scheduling: "fifo", DefaultLimit: 11, MaxLimit: 10}, errPolicyValue},
+		{"scheduling", policyT{Scheduling: "random"}, errScheduling},
+		{"pattern", policyT{Scheduling: "fifo", AllowedArgs: []string{"("}}, errPolicyValue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.compile()
+
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("compile() error = %v, want %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("compile() unexpected error: %v", err)
+			case tt.policy.scheduler == nil || len(tt.policy.patterns) != len(tt.policy.AllowedArgs):
+				t.Fatalf("compile() = %d patterns, scheduler %v", len(tt.policy.patterns), tt.policy.scheduler != nil)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy policyT
+		limit  float64
+		args   []string
+		want   float64
+		err    error
+	}{
+		{"no limits", policyT{}, 0, nil, 0, nil},
+		{"default limit", policyT{DefaultLimit: 5, MaxLimit: 10}, 0, nil, 5, nil},
+		{"max limit", policyT{MaxLimit: 10}, 0, nil, 10, nil},
+		{"given limit", policyT{DefaultLimit: 5, MaxLimit: 10}, 8, nil, 8, nil},
+		{"over max", policyT{MaxLimit: 10}, 11, nil, 0, errLimitMax},
+		{"args", policyT{AllowedArgs: []string{"-v", "[0-9]+"}}, 0, []string{"42", "-v"}, 0, nil},
+		{"partial match", policyT{AllowedArgs: []string{"[0-9]+"}}, 0, []string{"42;rm"}, 0, errArgPattern},
+		{"no match", policyT{AllowedArgs: []string{"-v"}}, 0, []string{"-v", "-x"}, 0, errArgPattern},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.Scheduling = "fifo"
+			if err := tt.policy.compile(); err != nil {
+				t.Fatalf("compile() unexpected error: %v", err)
+			}
+
+			req := &protocol.ClientReq{Limit: tt.limit, Args: tt.args}
+			err := tt.policy.check(req)
+
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("check() error = %v, want %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("check() unexpected error: %v", err)
+			case req.Limit != tt.want:
+				t.Fatalf("check() limit = %.1f, want %.1f", req.Limit, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	defaults := policyT{Scheduling: "fifo", MaxLength: 100}
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]int // queue max lengths
+		err     error
+		fail    bool
+	}{
+		{"empty", "", map[string]int{}, nil, false},
+		{"defaults", "queues:\n  a:\n  b:\n    max-length: 5\n", map[string]int{"a": 100, "b": 5}, nil, false},
+		{"json", `{"queues": {"a": {"max-length": 5}}}`, map[string]int{"a": 5}, nil, false},
+		{"unknown key", "queues:\n  a:\n    max_length: 5\n", nil, nil, true},
+		{"unknown top-level key", "queue:\n  a:\n", nil, nil, true},
+		{"invalid name", "queues:\n  a/b:\n", nil, errQueueName, true},
+		{"invalid value", "queues:\n  a:\n    max-length: -1\n", nil, errPolicyValue, true},
+		{"invalid scheduling", "queues:\n  a:\n    scheduling: random\n", nil, errScheduling, true},
+		{"invalid YAML", "queues: [\n", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := parseConfig(writeConfig(t, tt.content), &defaults)
+
+			switch {
+			case tt.fail:
+				if err == nil {
+					t.Fatalf("parseConfig() = %d policies, want failure", len(policies))
+				}
+
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("parseConfig() error = %v, want %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("parseConfig() unexpected error: %v", err)
+			default:
+				got := make(map[string]int, len(policies))
+				for name := range policies {
+					got[name] = policies[name].MaxLength
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("parseConfig() max lengths = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := parseConfig(filepath.Join(t.TempDir(), "missing.yaml"), &defaults); err == nil {
+		t.Fatal("parseConfig() for missing file succeeded")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	queues := &queuesT{
+		maps:       make(map[string]*queueT),
+		configured: make(map[string]bool),
+		settings:   queueSettingsT{policy: policyT{Scheduling: "fifo"}},
+	}
+
+	// queue created from command line
+	if err := queues.create("cli", &queues.settings.policy); err != nil {
+		t.Fatalf("create() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		fail    bool
+	}{
+		{"create", "queues:\n  a:\n  b:\n", []string{"a", "b", "cli"}, false},
+		{"remove", "queues:\n  b:\n", []string{"b", "cli"}, false},
+		{"update cli", "queues:\n  b:\n  cli:\n    max-length: 5\n", []string{"b", "cli"}, false},
+		{"drop cli", "queues:\n  b:\n", []string{"b", "cli"}, false},
+		{"invalid", "queues:\n  c:\n    max-length: -1\n", []string{"b", "cli"}, true},
+		{"empty", "", []string{"cli"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := queues.loadConfig(writeConfig(t, tt.content))
+
+			switch {
+			case tt.fail:
+				if err == nil {
+					t.Fatal("loadConfig() succeeded, want failure")
+				}
+			case err != nil:
+				t.Fatalf("loadConfig() unexpected error: %v", err)
+			}
+
+			got := make([]string, 0, len(queues.maps))
+			for name := range queues.maps {
+				got = append(got, name)
+			}
+
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("queues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// config policy for command line queue stays after it is dropped from config
+	if queue := queues.lookup("cli"); queue == nil || queue.policy.MaxLength != 5 {
+		t.Fatal("command line queue policy not updated from config")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// label value used for the series exceeding cardinality limit.
+const overflowLabel = "other"
+
+// per queue, node and device metrics key.
+type deviceKey struct {
+	queue, node, device string
+}
+
+type deviceStatT struct {
+	success uint64
+	failure uint64
+	runhist *histogramT
+}
+
+// deviceStatsT tracks worker reply statistics per queue, node and device.
+type deviceStatsT struct {
+	stats map[deviceKey]*deviceStatT
+	// histogram bucket bounds, shared
+	bounds []float64
+	// max number of tracked node + device label sets, 0=disabled
+	limit int
+	// replies accounted to the overflow label set
+	overflow uint64
+	// locking for those
+	mutex sync.Mutex
+}
+
+// newDeviceStats returns device statistics with given cardinality limit.
+func newDeviceStats(limit int, bounds []float64) *deviceStatsT {
+	return &deviceStatsT{
+		stats:  make(map[deviceKey]*deviceStatT),
+		bounds: bounds,
+		limit:  limit,
+	}
+}
+
+// add accounts given worker reply for given queue. Replies without node
+// info (frontend errors) are ignored.
+func (d *deviceStatsT) add(queue string, reply *protocol.Reply) {
+	if d.limit <= 0 || reply.Node == "" {
+		return
+	}
+
+	key := deviceKey{queue: queue, node: reply.Node, device: reply.Device}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stat, exists := d.stats[key]
+	if !exists {
+		// last label set is reserved for the overflow one
+		if len(d.stats) >= d.limit-1 {
+			key = deviceKey{queue: overflowLabel, node: overflowLabel, device: overflowLabel}
+			d.overflow++
+			stat = d.stats[key]
+		}
+
+		if stat == nil {
+			stat = &deviceStatT{runhist: newHistogram(d.bounds)}
+			d.stats[key] = stat
+		}
+	}
+
+	if reply.Retcode == 0 {
+		stat.success++
+		stat.runhist.observe(reply.Runtime)
+	} else {
+		stat.failure++
+	}
+}
+
+// export writes device metrics, if they are enabled.
+func (d *deviceStatsT) export(mw *metricWriter) {
+	if d.limit <= 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	keys := make([]deviceKey, 0, len(d.stats))
+	for key := range d.stats {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.queue != b.queue {
+			return a.queue < b.queue
+		}
+
+		if a.node != b.node {
+			return a.node < b.node
+		}
+
+		return a.device < b.device
+	})
+
+	labelsets := make([]string, len(keys))
+	for i, key := range keys {
+		labelsets[i] = labels("name", key.queue, "node", key.node, "device", key.device)
+	}
+
+	mw.family("hpa_device_success_total", counterType, "Items processed successfully, per node and device.")
+
+	for i, key := range keys {
+		mw.sample("hpa_device_success_total", labelsets[i], d.stats[key].success)
+	}
+
+	mw.family("hpa_device_failure_total", counterType, "Items whose processing failed, per node and device.")
+
+	for i, key := range keys {
+		mw.sample("hpa_device_failure_total", labelsets[i], d.stats[key].failure)
+	}
+
+	mw.family("hpa_device_run_seconds", histogramType, "Successful item run times, per node and device.")
+
+	for i, key := range keys {
+		mw.histogram("hpa_device_run_seconds", labelsets[i], d.stats[key].runhist)
+	}
+
+	mw.family("hpa_device_overflow_total", counterType, "Replies accounted to 'other' queue, node and device, due to cardinality limit.")
+	mw.sample("hpa_device_overflow_total", "", d.overflow)
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+func TestDeviceStatsLimit(t *testing.T) {
+	tests := []struct {
+		limit    int
+		replies  int
+		overflow uint64
+	}{
+		{0, 4, 0},
+		{1, 4, 8},
+		{3, 2, 0},
+		{3, 3, 1},
+		{3, 8, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit %d, %d replies", tt.limit, tt.replies), func(t *testing.T) {
+			d := newDeviceStats(tt.limit, nil)
+
+			for i := 0; i < tt.replies; i++ {
+				reply := protocol.Reply{Node: "node", Device: fmt.Sprintf("card%d", i)}
+				d.add("queue", &reply)
+				// already tracked label set is not overflow
+				d.add("queue", &protocol.Reply{Node: "node", Device: "card0"})
+			}
+
+			if len(d.stats) > tt.limit {
+				t.Fatalf("%d label sets, over limit %d", len(d.stats), tt.limit)
+			}
+
+			if d.overflow != tt.overflow {
+				t.Fatalf("overflow = %d, want %d", d.overflow, tt.overflow)
+			}
+		})
+	}
+}
+
+func TestDeviceStatsNoDevice(t *testing.T) {
+	d := newDeviceStats(2, nil)
+
+	d.add("queue", &protocol.Reply{Node: "node", Retcode: 1})
+	d.add("queue", &protocol.Reply{Retcode: 1})
+
+	stat := d.stats[deviceKey{queue: "queue", node: "node"}]
+	if stat == nil || stat.failure != 1 || len(d.stats) != 1 {
+		t.Fatalf("stats = %v, want one failure for node without device", d.stats)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// content types for Prometheus text and OpenMetrics exposition formats.
+	textType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	// metric types.
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+	// info metrics are gauges in Prometheus text format.
+	infoType = "info"
+)
+
+// metric label value escaper, same for both formats.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metric help text escaper.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// metricWriter writes metrics in Prometheus text, or OpenMetrics format.
+type metricWriter struct {
+	w           io.Writer
+	openmetrics bool
+}
+
+// newMetricWriter returns writer for the format negotiated based
+// on the request Accept header, and sets reply content type for it.
+func newMetricWriter(w http.ResponseWriter, r *http.Request) *metricWriter {
+	mw := &metricWriter{
+		w:           w,
+		openmetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text"),
+	}
+
+	if mw.openmetrics {
+		w.Header().Set("Content-Type", openMetricsType)
+	} else {
+		w.Header().Set("Content-Type", textType)
+	}
+
+	return mw
+}
+
+// labels returns given label name + value pairs in exposition format,
+// with label values escaped.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// addLabel returns given exposition format labels with given
+// (already escaped) name + value pair added to them.
+func addLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=\"%s\"", name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// formatFloat returns float value in exposition format.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// family writes HELP and TYPE lines for given metric. Counter and info
+// metric names are given with "_total" and "_info" suffixes, which
+// OpenMetrics drops from them. Prometheus text format does not have
+// info type, so gauge is used for it instead.
+func (mw *metricWriter) family(name, mtype, help string) {
+	switch {
+	case mw.openmetrics && mtype == counterType:
+		name = strings.TrimSuffix(name, "_total")
+	case mw.openmetrics && mtype == infoType:
+		name = strings.TrimSuffix(name, "_info")
+	case mtype == infoType:
+		mtype = gaugeType
+	}
+
+	fmt.Fprintf(mw.w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(mw.w, "# TYPE %s %s\n", name, mtype)
+}
+
+// sample writes integer metric sample.
+func (mw *metricWriter) sample(name, labels string, value uint64) {
+	fmt.Fprintf(mw.w, "%s%s %d\n", name, labels, value)
+}
+
+// sampleFloat writes floating point metric sample.
+func (mw *metricWriter) sampleFloat(name, labels string, value float64) {
+	fmt.Fprintf(mw.w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// histogram writes given histogram samples.
+func (mw *metricWriter) histogram(name, labels string, h *histogramT) {
+	cumulative := uint64(0)
+
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		mw.sample(name+"_bucket", addLabel(labels, "le", formatFloat(bound)), cumulative)
+	}
+
+	mw.sample(name+"_bucket", addLabel(labels, "le", "+Inf"), h.count)
+	mw.sampleFloat(name+"_sum", labels, h.sum)
+	mw.sample(name+"_count", labels, h.count)
+}
+
+// end terminates the exposition, OpenMetrics requires explicit EOF marker.
+func (mw *metricWriter) end() {
+	if mw.openmetrics {
+		fmt.Fprint(mw.w, "# EOF\n")
+	}
+}
@@ -3,169 +3,166 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
 )
 
 const (
 	project   = "Device Scalability Tester for Kubernetes - frontend"
 	version   = "v0.1"
-	tcpSize   = 1024 // max space for a TCP message
 	metricURL = "/metrics"
 )
 
 var (
 	verbose bool
+	msgmax  int // max size for a TCP message
+	// deadlines for reading client/worker request, and writing replies
+	rtimeout, wtimeout time.Duration
+	// accepted items count, gives item IDs. It is not per queue, so
+	// that IDs are unique also over queue re-creation
+	accepted atomic.Uint64
 )
 
-// client service request.
-type clientReq struct {
-	Queue string   // queue name
-	Args  []string // extra workload arguments
-	Limit float64  // workload run-time limit, in secs (0=default)
-}
-
-// worker work item request.
-type workReq struct {
-	Queue string // queue name
-}
-
-// work for worker.
-type workItem struct {
-	Error string   // non-empty on errors
-	Args  []string // extra workload arguments
-	Limit float64  // in secs (0=default)
-	Empty bool     // true if error is due to queue being empty
-}
-
 type queueItem struct {
 	// where to reply
 	client net.Conn
+	// closed when client disconnects, or its connection is closed
+	gone chan struct{}
+	// whether item is in queue, shared by item copies, set by queue
+	// buffer (with queue.mutex held)
+	queued *bool
 	// when pulled - when added = wait time
 	added time.Time
+	// queue name + sequence number, for workload args
+	id string
 	// marshaled to request
 	Args  []string
 	Limit float64
+	// failed deliveries to workers
+	retries int
+	// request + queue priority, higher priority items are served first
+	priority int
+	// client host, for fair scheduling
+	owner string
+	// requirements for worker labels
+	selector []protocol.Requirement
+}
+
+// worker waiting for an item to be added to an empty queue.
+type waiterT struct {
+	item chan queueItem
+	// worker labels
+	labels map[string]string
 }
 
 type queueT struct {
+	// queue name, set at startup
+	name string
 	// queue of items waiting to be processed
-	items []queueItem
+	items itemQueueT
+	// workers waiting for items, longest waiting first
+	waiters []*waiterT
 	// number of items being processed
 	running int
 	// queue processing statistics
 	disconnect uint64
+	expired    uint64
+	canceled   uint64
+	requeued   uint64
 	success    uint64
 	failure    uint64
 	// queue processing timings
 	maxtotal float64
 	maxwait  float64
 	maxrun   float64
+	// and their histograms
+	waithist  *histogramT
+	runhist   *histogramT
+	totalhist *histogramT
+	// wait time histograms per item priority
+	priohist map[int]*histogramT
+	// paused queue does not hand out items, draining one does
+	// not accept new items, deleted one is not in queue map, and
+	// stopping one belongs to a frontend that is shutting down
+	paused   bool
+	draining bool
+	deleted  bool
+	stopping bool
+	// queue policy, can be reloaded
+	policy policyT
+	// fair scheduling serial, and its value when given
+	// client (host) was last served
+	serial uint64
+	served map[string]uint64
 	// locking for those
 	mutex sync.Mutex
+	// worker item lease time (0=unlimited), max worker wait
+	// time for items and max redeliveries, set at creation
+	lease   time.Duration
+	wait    time.Duration
+	retries int
+}
+
+// settings for new queues.
+type queueSettingsT struct {
+	lease   time.Duration
+	wait    time.Duration
+	retries int
+	// histogram bucket bounds
+	bounds []float64
+	// max time to wait for running items on shutdown
+	grace time.Duration
+	// policy for queues not defined in config file, and
+	// defaults for policy values missing from config file
+	policy policyT
 }
 
 // type is needed to be able to have methods for queues, and
 // queueT needs to be pointer as address cannot be taken for map index.
-// maps is created and interval set at startup, they are not modified
-// after goroutines are created and therefore do not need locking.
+// Queues can be added and removed at run-time, so maps access needs
+// locking, but interval is set at startup and not modified after that.
 type queuesT struct {
 	maps map[string]*queueT
+	// set when frontend starts shutting down, no queues
+	// are created after that
+	stopping bool
+	// locking for queue map and shutdown state
+	mapsMutex sync.RWMutex
+	// settings for new queues, set at startup
+	settings queueSettingsT
+	// queues created from config file, accessed only from main thread
+	configured map[string]bool
 	// connection counters
 	clients uint64
 	workers uint64
 	metrics uint64
+	// request read timeout counters
+	ctimeouts uint64
+	wtimeouts uint64
 	// locking for connection counters
-	mutex    sync.Mutex
+	mutex sync.Mutex
+	// slots for client and worker connections still in
+	// request handshake, set at startup
+	chandshakes handshakesT
+	whandshakes handshakesT
+	// per-node + device worker reply stats, set at startup
+	devices *deviceStatsT
+	// worker registry, set at startup
+	registry *registryT
 	interval int // >0 to enable stats logging (secs)
 }
 
-// worker -> frontend -> client return replies.
-type replyT struct {
-	Pod      string  // who did work
-	Node     string  // on which node
-	Device   string  // device mapped to worker, if any
-	Error    string  // non-empty on errors
-	Timeout  float64 // >0 = workload timed out
-	Runtime  float64 // workload run time, in secs
-	Waittime float64 // queue wait time, in secs, added by frontend
-	Retcode  int     // workload return code
-}
-
-func requestCheck(r *http.Request) int {
-	if r.Method != http.MethodGet {
-		return http.StatusMethodNotAllowed
-	}
-
-	if r.URL.Path != metricURL {
-		return http.StatusNotFound
-	}
-
-	if r.Body != http.NoBody {
-		return http.StatusBadRequest
-	}
-
-	return http.StatusOK
-}
-
-// exporter reports queue statistics as Prometheus metrics,
-// resets max times on each query unless stats logging + reset
-// interval is enabled.
-func (queues *queuesT) exporter(w http.ResponseWriter, r *http.Request) {
-	if status := requestCheck(r); status != http.StatusOK {
-		w.WriteHeader(status)
-		return
-	}
-
-	if verbose {
-		log.Printf("metrics query from '%s'", r.RemoteAddr)
-	}
-	// report results and reset max timer
-	fmt.Fprintf(w, "# %s %s\n", project, version)
-
-	queues.mutex.Lock()
-	fmt.Fprintf(w, "hpa_client_connections_total %d\n", queues.clients)
-	fmt.Fprintf(w, "hpa_worker_connections_total %d\n", queues.workers)
-	queues.metrics++
-	queues.mutex.Unlock()
-
-	for name, q := range queues.maps {
-		q.mutex.Lock()
-
-		fmt.Fprintf(w, "hpa_queue_all{name=\"%s\"} %d\n", name, len(q.items)+q.running)
-		fmt.Fprintf(w, "hpa_queue_waiting{name=\"%s\"} %d\n", name, len(q.items))
-		fmt.Fprintf(w, "hpa_queue_running{name=\"%s\"} %d\n", name, q.running)
-		fmt.Fprintf(w, "hpa_queue_success_total{name=\"%s\"} %d\n", name, q.success)
-		fmt.Fprintf(w, "hpa_queue_failure_total{name=\"%s\"} %d\n", name, q.failure)
-		fmt.Fprintf(w, "hpa_queue_disconnect_total{name=\"%s\"} %d\n", name, q.disconnect)
-
-		if queues.interval > 0 {
-			labels := fmt.Sprintf("name=\"%s\",interval=\"%ds\"", name, queues.interval)
-			fmt.Fprintf(w, "hpa_queue_maxrun_seconds{%s} %g\n", labels, q.maxrun)
-			fmt.Fprintf(w, "hpa_queue_maxwait_seconds{%s} %g\n", labels, q.maxwait)
-			fmt.Fprintf(w, "hpa_queue_maxtotal_seconds{%s} %g\n", labels, q.maxtotal)
-		} else {
-			fmt.Fprintf(w, "hpa_queue_maxrun_seconds{name=\"%s\"} %g\n", name, q.maxrun)
-			fmt.Fprintf(w, "hpa_queue_maxwait_seconds{name=\"%s\"} %g\n", name, q.maxwait)
-			fmt.Fprintf(w, "hpa_queue_maxtotal_seconds{name=\"%s\"} %g\n", name, q.maxtotal)
-
-			q.maxrun, q.maxwait, q.maxtotal = 0, 0, 0
-		}
-
-		q.mutex.Unlock()
-	}
-}
-
 // logStats logs queue statistics at specified interval, resets max times after each output.
 func (queues *queuesT) logStats() {
 	log.Printf("Logging queue statistics at %ds interval", queues.interval)
@@ -174,11 +171,11 @@ func (queues *queuesT) logStats() {
 	for {
 		time.Sleep(duration)
 
-		for name, q := range queues.maps {
+		for _, q := range queues.list() {
 			q.mutex.Lock()
 
-			log.Printf("%s: %d backend successes, %d failures - %d still running (max %.2fs), %d waiting (max %.1fs) in queue (with max total %.1fs) - %d client disconnects",
-				name, q.success, q.failure, q.running, q.maxrun, len(q.items), q.maxwait, q.maxtotal, q.disconnect)
+			log.Printf("%s: %d backend successes, %d failures - %d still running (max %.2fs), %d waiting (max %.1fs) in queue (with max total %.1fs) - %d client disconnects, %d expired, %d canceled, %d requeues",
+				q.name, q.success, q.failure, q.running, q.maxrun, q.items.len(), q.maxwait, q.maxtotal, q.disconnect, q.expired, q.canceled, q.requeued)
 
 			q.maxrun, q.maxwait, q.maxtotal = 0, 0, 0
 
@@ -186,193 +183,501 @@ func (queues *queuesT) logStats() {
 		}
 
 		queues.mutex.Lock()
-		log.Printf("%d client, %d metric and %d worker connections in total", queues.clients, queues.metrics, queues.workers)
+		log.Printf("%d client, %d metric and %d worker connections in total, with %d client and %d worker handshake timeouts",
+			queues.clients, queues.metrics, queues.workers, queues.ctimeouts, queues.wtimeouts)
 		queues.mutex.Unlock()
 	}
 }
 
-// sendJSONClose sends given data and closes connnection.
-func sendJSONClose(conn net.Conn, data []byte) {
-	if verbose {
-		log.Printf("Closing reply (%d bytes): %v", len(data), string(data))
+// setDeadline sets given connection read or write deadline to given
+// timeout from now, or removes the deadline if timeout is zero.
+func setDeadline(conn net.Conn, timeout time.Duration, write bool) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
 
-	n, err := conn.Write(data)
-	if err != nil || n != len(data) {
-		log.Printf("WARN: JSON msg write (%d/%d bytes) failed: %v", n, len(data), err)
+	var err error
+	if write {
+		err = conn.SetWriteDeadline(deadline)
+	} else {
+		err = conn.SetReadDeadline(deadline)
+	}
+
+	if err != nil {
+		log.Printf("WARN: failed to set connection deadline: %v", err)
+	}
+}
+
+// send sends given message with a write deadline.
+// Returns sent data (for logging) and error.
+func send(conn net.Conn, msg interface{}) ([]byte, error) {
+	setDeadline(conn, wtimeout, true)
+	return protocol.Send(conn, msg, msgmax)
+}
+
+// sendClose sends given message and closes connnection.
+func sendClose(conn net.Conn, msg interface{}) {
+	data, err := send(conn, msg)
+	if err != nil {
+		log.Printf("WARN: message send failed: %v", err)
+	} else if verbose {
+		log.Printf("Closing reply (%d bytes): %v", len(data), string(data))
 	}
 
 	conn.Close()
 }
 
-// errorReplyClose marshals + sends given error reply, and closes connection.
+// errorReplyClose sends given error reply, and closes connection.
 func errorReplyClose(conn net.Conn, msg string) {
-	reply := replyT{Error: msg, Retcode: 1}
-	data, err := json.MarshalIndent(reply, "", "\t")
+	sendClose(conn, protocol.NewErrorReply(msg))
+}
+
+// rejectT is error reply for a client whose item was removed from
+// queue, to be sent after queue mutex has been released.
+type rejectT struct {
+	client net.Conn
+	msg    string
+}
+
+// sendRejects sends given error replies, and closes their connections.
+// Must be called without queue mutex held, as writes can take up to
+// write timeout.
+func sendRejects(rejects []rejectT) {
+	for _, r := range rejects {
+		errorReplyClose(r.client, r.msg)
+	}
+}
+
+// receive receives given request message from given connection, within
+// read deadline. Returns true if reading failed due to deadline.
+func receive(conn net.Conn, msg interface{}) (bool, error) {
+	setDeadline(conn, rtimeout, false)
+
+	data, err := protocol.Receive(conn, msg, msgmax)
+	if verbose {
+		log.Printf("Request from '%s' (%d bytes): %v", conn.RemoteAddr(), len(data), string(data))
+	}
 
 	if err != nil {
-		log.Fatalf("ERROR: internal replyT JSON marshaling error: %v", err)
+		return errors.Is(err, os.ErrDeadlineExceeded), err
 	}
 
-	sendJSONClose(conn, data)
-}
+	setDeadline(conn, 0, false)
 
-// listenForClients accepts client connections, validates the service request,
-// and either returns an error, or adds the request to specified queue with
-// the connection needed to return the data.
-func (queues *queuesT) listenForClients(address string, qmax int) {
-	log.Printf("Queueing client service request work items on %s", address)
+	return false, nil
+}
 
+// listen returns listener for given address, or terminates on failure.
+func listen(address string) net.Listener {
 	l, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("Listening on '%s' failed: %v", address, err)
 	}
 
-	data := make([]byte, tcpSize)
+	return l
+}
 
+// handshakesT limits number of connections concurrently in request
+// handshake on a listener, so that idle connections on one port do
+// not block accepting connections on the other one.
+type handshakesT chan struct{}
+
+// accept waits for a free handshake slot, and then accepts next
+// connection. Slot needs to be released after connection request
+// has been handled.
+func (h handshakesT) accept(l net.Listener) net.Conn {
 	for {
+		h <- struct{}{}
+
 		if verbose {
-			log.Print("Accepting next client...")
+			log.Printf("Accepting next connection on %s...", l.Addr())
 		}
 
 		conn, err := l.Accept()
-		if err != nil {
-			log.Printf("Accept for '%s' failed: %v", address, err)
-			continue
+		if err == nil {
+			return conn
 		}
 
+		<-h
+		log.Printf("Accept for '%s' failed: %v", l.Addr(), err)
+	}
+}
+
+// release frees handshake slot taken by accept.
+func (h handshakesT) release() {
+	<-h
+}
+
+// listenForClients accepts client connections and handles their requests
+// in separate goroutines.
+func (queues *queuesT) listenForClients(address string) {
+	log.Printf("Queueing client service request work items on %s", address)
+
+	l := listen(address)
+
+	for {
+		conn := queues.chandshakes.accept(l)
+
 		queues.mutex.Lock()
 		queues.clients++
 		queues.mutex.Unlock()
 
-		if verbose {
-			log.Print("Reading client request...")
-		}
+		go queues.handleClient(conn)
+	}
+}
 
-		var n int
-		n, err = conn.Read(data)
+// handleClient validates the client service request, and either returns
+// an error, or adds the request to specified queue with the connection
+// needed to return the data.
+func (queues *queuesT) handleClient(conn net.Conn) {
+	defer queues.chandshakes.release()
 
-		if n <= 0 || err != nil {
-			errorReplyClose(conn, fmt.Sprintf("No bytes (%d) / error (%s) from read", n, err))
-			continue
-		}
+	var req protocol.ClientReq
 
-		if verbose {
-			log.Printf("Service request (%d bytes): %v", n, string(data))
+	timeout, err := receive(conn, &req)
+	if err != nil {
+		if timeout {
+			queues.mutex.Lock()
+			queues.ctimeouts++
+			queues.mutex.Unlock()
 		}
 
-		var req clientReq
-		if err = json.Unmarshal(data[:n], &req); err != nil {
-			errorReplyClose(conn, fmt.Sprintf("Unmarshaling clientReq JSON failed: %v", err))
-			continue
-		}
+		errorReplyClose(conn, fmt.Sprintf("Receiving client request failed: %v", err))
 
-		name := req.Queue
-		if name == "" {
-			errorReplyClose(conn, "invalid queue name ''")
-			continue
-		}
+		return
+	}
 
-		if _, exists := queues.maps[name]; !exists {
-			errorReplyClose(conn, fmt.Sprintf("Unknown '%s' queue", name))
-			continue
-		}
+	if err = req.Validate(); err != nil {
+		errorReplyClose(conn, fmt.Sprintf("Invalid client request: %v", err))
+		return
+	}
 
-		queue := queues.maps[name]
+	selector, err := protocol.ParseSelector(req.Selector)
+	if err != nil {
+		errorReplyClose(conn, fmt.Sprintf("Invalid client request: %v", err))
+		return
+	}
 
-		queue.mutex.Lock()
-		if qmax > 0 && len(queue.items) >= qmax {
-			errorReplyClose(conn, fmt.Sprintf("'%s' queue already at full capacity (%d)", name, qmax))
-		} else {
-			// all OK, add to queue
-			item := queueItem{
-				Limit:  req.Limit,
-				Args:   req.Args,
-				added:  time.Now(),
-				client: conn,
+	name := req.Queue
+
+	queue := queues.lookup(name)
+	if queue == nil {
+		errorReplyClose(conn, fmt.Sprintf("Unknown '%s' queue", name))
+		return
+	}
+
+	// error reply is sent only after queue mutex is released
+	if msg := queue.enqueue(conn, &req, selector); msg != "" {
+		errorReplyClose(conn, msg)
+	}
+}
+
+// enqueue adds given client request with given connection and parsed
+// selector to queue, and starts watching for client disconnect.
+// Returns error message if request was not accepted.
+func (queue *queueT) enqueue(conn net.Conn, req *protocol.ClientReq, selector []protocol.Requirement) string {
+	name := queue.name
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.deleted {
+		return fmt.Sprintf("Unknown '%s' queue", name)
+	}
+
+	if queue.stopping {
+		return errShutdown.Error()
+	}
+
+	if queue.draining {
+		return fmt.Sprintf("'%s' queue is draining, no new requests accepted", name)
+	}
+
+	if queue.policy.MaxLength > 0 && queue.items.len() >= queue.policy.MaxLength {
+		return fmt.Sprintf("'%s' queue already at full capacity (%d)", name, queue.policy.MaxLength)
+	}
+
+	if err := queue.policy.check(req); err != nil {
+		return fmt.Sprintf("Request not allowed by '%s' queue policy: %v", name, err)
+	}
+
+	item := queueItem{
+		id:       fmt.Sprintf("%s-%d", name, accepted.Add(1)),
+		gone:     make(chan struct{}),
+		queued:   new(bool),
+		selector: selector,
+		Limit:    req.Limit,
+		Args:     req.Args,
+		added:    time.Now(),
+		client:   conn,
+		priority: queue.policy.Priority + req.Priority,
+		owner:    clientOwner(conn),
+	}
+
+	if queue.policy.MaxBytes > 0 && queue.items.size()+itemSize(&item) > queue.policy.MaxBytes {
+		return fmt.Sprintf("'%s' queue already at full memory capacity (%d bytes)", name, queue.policy.MaxBytes)
+	}
+
+	// all OK, add to queue, and start watching for client disconnect
+	queue.addItem(item, false)
+
+	go queue.watchClient(&item)
+
+	return ""
+}
+
+// canRun returns true if queue is not paused, and its policy allows
+// running more items. Must be called with queue.mutex held.
+func (queue *queueT) canRun() bool {
+	return !queue.paused && (queue.policy.MaxRunning <= 0 || queue.running < queue.policy.MaxRunning)
+}
+
+// addItem adds given item to queue front or back, or if there are workers
+// waiting for items, and more items can be run, hands it directly to the
+// longest waiting worker whose labels match item selector.
+// Must be called with queue.mutex held.
+func (queue *queueT) addItem(item queueItem, front bool) {
+	if queue.canRun() {
+		for i, waiter := range queue.waiters {
+			if !protocol.MatchesAll(item.selector, waiter.labels) {
+				continue
 			}
-			queue.items = append(queue.items, item)
+
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			queue.running++
+			// buffered, does not block
+			waiter.item <- item
+
+			return
 		}
-		queue.mutex.Unlock()
+	}
+
+	if front {
+		queue.items.pushFront(item)
+	} else {
+		queue.items.pushBack(item)
+	}
+}
+
+// dispatch hands queued items to waiting workers with matching labels,
+// as long as queue policy allows running more of them.
+// Must be called with queue.mutex held.
+func (queue *queueT) dispatch() {
+	for i := 0; i < len(queue.waiters) && queue.canRun(); {
+		waiter := queue.waiters[i]
+
+		item, ok := queue.takeItem(waiter.labels)
+		if !ok {
+			i++
+			continue
+		}
+
+		queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+		queue.running++
+		// buffered, does not block
+		waiter.item <- item
 	}
 }
 
-// processItem sends given item to worker and waits for reply.
-// Worker reply (or failure) info is sent back to client, both client
-// and worker connections are closed, and processing info returned.
-func processItem(worker net.Conn, item queueItem) replyT {
-	// marshal work item
-	workitem := workItem{
-		Limit: item.Limit,
-		Args:  item.Args,
+// releaseWaiters wakes up all workers waiting for items, without
+// handing them any. Must be called with queue.mutex held.
+func (queue *queueT) releaseWaiters() {
+	for _, waiter := range queue.waiters {
+		close(waiter.item)
 	}
 
-	data, err := json.MarshalIndent(workitem, "", "\t")
-	if err != nil {
-		log.Fatalf("ERROR: internal workItem error JSON marshaling error: %v", err)
+	queue.waiters = nil
+}
+
+// waitItem waits at most given time for an item to be handed to given
+// waiter, already added to queue waiters, or until given channel is
+// closed (worker disconnected). Returns false if no item arrived, or
+// waiters were released.
+func (queue *queueT) waitItem(waiter *waiterT, wait time.Duration, gone <-chan struct{}) (queueItem, bool) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case item, ok := <-waiter.item:
+		return item, ok
+	case <-timer.C:
+	case <-gone:
 	}
 
-	if verbose {
-		log.Printf("Work item to worker (%d bytes): %v", len(data), string(data))
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for i, w := range queue.waiters {
+		if w == waiter {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			return queueItem{}, false
+		}
 	}
 
+	// item was handed over (or waiters released) while timer expired
+	item, ok := <-waiter.item
+
+	return item, ok
+}
+
+// processItem sends given item to worker and waits for reply, for at most
+// given lease time. Worker reply (or failure) info is sent back to client,
+// both client and worker connections are closed, and processing info
+// returned.
+//
+// If sending the item to worker fails, or worker does not reply within
+// the lease, item is still owned by frontend: nothing is sent to client,
+// and true is returned to indicate that the item should be requeued.
+func processItem(worker net.Conn, item *queueItem, lease time.Duration) (protocol.Reply, bool) {
+	workitem := protocol.NewWorkItem(item.id, item.Args, item.Limit)
+
 	queuetime := time.Since(item.added).Seconds()
-	reply := replyT{
+	reply := protocol.Reply{
 		Waittime: queuetime,
 		Retcode:  1,
 	}
 
 	// send the item and wait for reply
-	n, err := worker.Write(data)
-	if err != nil || n != len(data) {
-		errorReplyClose(item.client, fmt.Sprintf("Worker write (%d/%d bytes) failed: %v\n", n, len(data), err))
+	data, err := send(worker, workitem)
+	if err != nil {
+		log.Printf("WARN: sending work item to worker '%s' failed: %v", worker.RemoteAddr(), err)
 		worker.Close()
 
-		return reply
+		return reply, true
+	}
+
+	if verbose {
+		log.Printf("Work item to worker (%d bytes): %v", len(data), string(data))
 	}
 
-	data = make([]byte, tcpSize)
-	n, err = worker.Read(data)
+	data, err = readReply(worker, item, lease)
 	worker.Close()
 
-	if n <= 0 || err != nil {
-		errorReplyClose(item.client, fmt.Sprintf("No bytes (%d) / error (%v) from worker reply read", n, err))
-		return reply
+	if verbose {
+		log.Printf("Worker reply (%d bytes): %v", len(data), string(data))
 	}
 
-	if verbose {
-		log.Printf("Worker reply (%d bytes): %v", n, string(data))
+	if err != nil {
+		log.Printf("WARN: no reply from worker '%s' (within %v lease): %v", worker.RemoteAddr(), lease, err)
+		return reply, true
 	}
 
-	// unmarshal reply, add queueing time back to it, remarshal and send it
-	err = json.Unmarshal(data[:n], &reply)
+	err = protocol.Decode(data, &reply)
+
+	// add queueing time back to reply and send it
 	reply.Waittime = queuetime
 
 	if err != nil {
-		errorReplyClose(item.client, fmt.Sprintf("Unmarshaling worker reply JSON failed: %v", err))
+		errorReplyClose(item.client, fmt.Sprintf("Decoding worker reply failed: %v", err))
 
 		reply.Retcode = 1
 
-		return reply
+		return reply, false
 	}
 
-	data, err = json.MarshalIndent(reply, "", "\t")
-	if err != nil {
-		log.Fatalf("ERROR: internal replyT JSON marshaling error: %v", err)
+	if item.isGone() {
+		// nobody to reply to
+		item.client.Close()
+		return reply, false
 	}
 
-	sendJSONClose(item.client, data)
+	sendClose(item.client, reply)
 
-	return reply
+	return reply, false
 }
 
-// doItem checks that client for the work item is still there, processes it
-// and updates queue statistics accordingly after work item reply is completed.
-func doItem(worker net.Conn, item queueItem, queue *queueT) {
-	reply := processItem(worker, item)
+// requeueItem puts item whose delivery to worker failed back to the
+// queue head, if it has retries left. Returns false if item could not
+// be requeued, along with error message to send to its client after
+// queue.mutex is released (empty if client is gone). Item that could
+// not be requeued is counted as a failure, or as a disconnect if its
+// client is gone. Must be called with queue.mutex held.
+func requeueItem(item *queueItem, queue *queueT) (bool, string) {
+	if item.isGone() {
+		queue.discardGone(item)
+		return false, ""
+	}
+
+	msg := ""
+
+	switch {
+	case queue.deleted:
+		msg = fmt.Sprintf("Work item delivery to worker failed, and '%s' queue was deleted", queue.name)
+	case queue.stopping:
+		msg = fmt.Sprintf("Work item delivery to worker failed, and %v", errShutdown)
+	case item.retries >= queue.retries:
+		msg = fmt.Sprintf("Work item delivery to workers failed %d times", item.retries+1)
+	}
+
+	if msg != "" {
+		queue.failure++
+		return false, msg
+	}
+
+	item.retries++
+	queue.addItem(*item, true)
+	queue.requeued++
+
+	return true, ""
+}
+
+// doItem processes given work item with given worker, and updates
+// queue statistics accordingly after work item reply is completed,
+// or requeues it if processing failed due to worker. Returns false
+// if item was not sent to worker because its client had already
+// disconnected, so that worker can be given another item.
+func (queues *queuesT) doItem(worker net.Conn, id string, item queueItem, queue *queueT) bool {
+	if item.isGone() {
+		queue.mutex.Lock()
+		queue.running--
+		queue.discardGone(&item)
+		queue.dispatch()
+		queue.mutex.Unlock()
+
+		return false
+	}
+
+	queues.registry.started(id, "", queue.name)
+	reply, requeue := processItem(worker, &item, queue.lease)
+	queues.registry.finished(id, reply.Node, queue.name, !requeue)
+
+	if !requeue && !reply.Canceled {
+		queues.devices.add(queue.name, &reply)
+	}
 
 	queue.mutex.Lock()
-	defer queue.mutex.Unlock()
+
+	queue.running--
+	queue.dispatch()
+
+	if requeue {
+		requeued, msg := requeueItem(&item, queue)
+		queue.mutex.Unlock()
+
+		if requeued {
+			log.Printf("Requeued work item (retry %d/%d)", item.retries, queue.retries)
+		} else if msg != "" {
+			errorReplyClose(item.client, msg)
+		}
+
+		return true
+	}
+
+	queue.completed(&item, &reply)
+	queue.mutex.Unlock()
+
+	return true
+}
+
+// completed updates queue statistics for given item with given worker
+// reply. Must be called with queue.mutex held.
+func (queue *queueT) completed(item *queueItem, reply *protocol.Reply) {
+	if reply.Canceled {
+		// run-time of canceled items does not tell much
+		queue.canceled++
+		return
+	}
 
 	if reply.Waittime > queue.maxwait {
 		queue.maxwait = reply.Waittime
@@ -387,211 +692,339 @@ func doItem(worker net.Conn, item queueItem, queue *queueT) {
 		queue.maxtotal = total
 	}
 
+	queue.waithist.observe(reply.Waittime)
+	queue.priorityHist(item.priority).observe(reply.Waittime)
+	queue.runhist.observe(reply.Runtime)
+	queue.totalhist.observe(total)
+
 	if reply.Retcode == 0 {
 		queue.success++
 	} else {
 		queue.failure++
 	}
-	queue.running--
 }
 
-// errorItemClose marshals + sends given error item, and closes connection.
+// errorItemClose sends given error item, and closes connection.
 func errorItemClose(conn net.Conn, empty bool, msg string) {
-	reply := workItem{Error: msg, Empty: empty}
+	sendClose(conn, protocol.NewErrorItem(empty, msg))
+}
 
-	data, err := json.MarshalIndent(reply, "", "\t")
-	if err != nil {
-		log.Fatalf("ERROR: internal workItem error JSON marshaling error: %v", err)
-	}
+// listenForWorkers accepts worker connections and handles their requests
+// in separate goroutines.
+func (queues *queuesT) listenForWorkers(address string) {
+	log.Printf("Providing queued work items for backends on %s", address)
+
+	l := listen(address)
+
+	for {
+		conn := queues.whandshakes.accept(l)
+
+		queues.mutex.Lock()
+		queues.workers++
+		queues.mutex.Unlock()
 
-	sendJSONClose(conn, data)
+		go queues.handleWorker(conn)
+	}
 }
 
-// countObsolete returns number of items (at queue front) for
-// which client has disconnected (and closes their connections).
-func countObsolete(queue *queueT) int {
-	count := 0
-	buf := make([]byte, 1)
+// handleWorker validates the queue item pull request, and either returns
+// an error, or provides the first item, and waits for a reply for it.
+func (queues *queuesT) handleWorker(conn net.Conn) {
+	var req protocol.WorkReq
 
-	for _, item := range queue.items {
-		// TODO:annoyingly, for disconnect detection to work,
-		// it must try non-zero sized read with deadline in
-		// *future* i.e. this adds delay to request processing
-		//
-		// Unix module would allow checking connection state
-		// (extract its FD, use syscalls to check the state),
-		// but it's not in Golang standard library
-		if err := item.client.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
-			log.Fatalf("ERROR: failed to set read deadline: %v", err)
+	timeout, err := receive(conn, &req)
+	if err != nil {
+		if timeout {
+			queues.mutex.Lock()
+			queues.wtimeouts++
+			queues.mutex.Unlock()
 		}
 
-		_, err := item.client.Read(buf)
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			// conn still OK, disable deadline
-			if err := item.client.SetReadDeadline(time.Time{}); err != nil {
-				log.Fatalf("ERROR: failed to remove read deadline: %v", err)
-			}
-			// check next queue item
-			break
-		}
-		// client gone -> close
-		item.client.Close()
-		count++
+		errorItemClose(conn, false, fmt.Sprintf("Receiving work request failed: %v", err))
+		queues.whandshakes.release()
+
+		return
 	}
 
-	return count
-}
+	if err = req.Validate(); err != nil {
+		errorItemClose(conn, false, fmt.Sprintf("Invalid work request: %v", err))
+		queues.whandshakes.release()
 
-// listenForWorkers accepts worker connections, validates the queue item
-// pull request, and either returns an error, or provides the first item
-// and starts a goroutine sending reply, waiting for a reply and closing
-// connection.
-func (queues *queuesT) listenForWorkers(address string) {
-	log.Printf("Providing queued work items for backends on %s", address)
+		return
+	}
 
-	l, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatalf("Listening on '%s' failed: %v", address, err)
+	name := req.Queue
+
+	queue := queues.lookup(name)
+	if queue == nil {
+		errorItemClose(conn, false, fmt.Sprintf("Unknown '%s' queue", name))
+		queues.whandshakes.release()
+
+		return
 	}
 
-	data := make([]byte, tcpSize)
+	id := workerID(req.Pod, req.Slot, conn)
+	queues.registry.pulled(id, req.Node, name, req.Labels)
+
+	// handshake slot is released on first item lookup
+	release := queues.whandshakes.release
 
 	for {
-		if verbose {
-			log.Print("Accepting next worker...")
+		item, ok := queues.workerItem(conn, id, queue, &req, release)
+		if !ok {
+			return
 		}
 
-		conn, err := l.Accept()
-		if err != nil {
-			log.Printf("Accept for '%s' failed: %v", address, err)
-			continue
+		if queues.doItem(conn, id, item, queue) {
+			return
 		}
 
-		queues.mutex.Lock()
-		queues.workers++
-		queues.mutex.Unlock()
-
-		if verbose {
-			log.Print("Reading worker spec...")
-		}
+		// item client disconnected before delivery, try next item
+		release = func() {}
+	}
+}
 
-		var n int
+// workerItem returns next item from given queue for given worker
+// connection and request, waiting for one if requested and queue is
+// empty. If there's no item, error reply is sent to the worker, and
+// false returned. Given function is called to release the worker
+// handshake slot before waiting for item, or processing it.
+func (queues *queuesT) workerItem(conn net.Conn, id string, queue *queueT, req *protocol.WorkReq, release func()) (queueItem, bool) {
+	name := req.Queue
 
-		n, err = conn.Read(data)
-		if n <= 0 || err != nil {
-			errorItemClose(conn, false, fmt.Sprintf("No bytes (%d) / error (%v) from read", n, err))
-			continue
-		}
+	queue.mutex.Lock()
 
-		if verbose {
-			log.Printf("Work item request (%d bytes): %v", n, string(data))
+	if queue.deleted || queue.stopping {
+		// stopping queue looks empty to workers, so that they back off
+		empty, msg := false, fmt.Sprintf("Unknown '%s' queue", name)
+		if queue.stopping {
+			empty, msg = true, errShutdown.Error()
 		}
 
-		var req workReq
-		if err = json.Unmarshal(data[:n], &req); err != nil {
-			errorItemClose(conn, false, fmt.Sprintf("Unmarshaling workReq JSON failed: %v", err))
-			continue
-		}
+		queue.mutex.Unlock()
+		errorItemClose(conn, empty, msg)
+		release()
 
-		name := req.Queue
-		if name == "" {
-			errorItemClose(conn, false, "invalid queue name ''")
-			continue
-		}
+		return queueItem{}, false
+	}
 
-		if _, exists := queues.maps[name]; !exists {
-			errorItemClose(conn, false, fmt.Sprintf("Unknown '%s' queue", name))
-			continue
-		}
+	queue.expire(time.Now())
 
-		queue := queues.maps[name]
+	if queue.canRun() {
+		if item, ok := queue.takeItem(req.Labels); ok {
+			queue.running++
+			queue.mutex.Unlock()
 
-		queue.mutex.Lock()
+			// handshake done, processing the item can take a long time
+			release()
 
-		offset := countObsolete(queue)
-		if offset > 0 {
-			log.Printf("WARN: discarded %d requests from disappeared client(s)", offset)
-			queue.disconnect += uint64(offset)
+			return item, true
 		}
+	}
 
-		if offset >= len(queue.items) {
-			errorItemClose(conn, true, fmt.Sprintf("Queue '%s' is empty", name))
+	wait := time.Duration(uint64(1000*req.Wait)) * time.Millisecond
+	if wait > queue.wait {
+		wait = queue.wait
+	}
 
-			queue.items = []queueItem{}
-		} else {
-			// new goroutine for the connection
-			go doItem(conn, queue.items[offset], queue)
+	if wait <= 0 {
+		// paused or fully running queue looks empty to workers
+		msg := fmt.Sprintf("Queue '%s' is empty", name)
 
-			queue.items = queue.items[offset+1:]
-			queue.running++
+		switch {
+		case queue.paused:
+			msg = fmt.Sprintf("Queue '%s' is paused", name)
+		case !queue.canRun():
+			msg = fmt.Sprintf("Queue '%s' already has max number (%d) of items running", name, queue.running)
 		}
+
 		queue.mutex.Unlock()
+		errorItemClose(conn, true, msg)
+		release()
+
+		return queueItem{}, false
 	}
-}
 
-func listenPrometheus(addr string, queues *queuesT) {
-	// Set both header and whole message timeout to same value
-	// as handler rejects HTTP queries with a body
-	server := &http.Server{
-		Addr:              addr,
-		ReadTimeout:       time.Second,
-		ReadHeaderTimeout: time.Second,
-		MaxHeaderBytes:    4096,
+	// long poll: wait for next item to be handed over, also while
+	// queue is paused or fully running
+	waiter := &waiterT{item: make(chan queueItem, 1), labels: req.Labels}
+	queue.waiters = append(queue.waiters, waiter)
+	queue.mutex.Unlock()
+	release()
+
+	// disconnected worker needs to be removed from waiters, so
+	// that items are not handed to it
+	gone, stop := watchWorker(conn)
+	item, ok := queue.waitItem(waiter, wait, gone)
+
+	stop()
+
+	if ok {
+		return item, true
 	}
 
-	http.HandleFunc(metricURL, queues.exporter)
-	log.Printf("Listening queue metric queries on %s%s", addr, metricURL)
-	log.Fatal(server.ListenAndServe())
+	select {
+	case <-gone:
+		log.Printf("WARN: worker '%s' disconnected while waiting for '%s' queue items", id, name)
+		conn.Close()
+	default:
+		errorItemClose(conn, true, fmt.Sprintf("Queue '%s' is still empty after %v", name, wait))
+	}
+
+	return queueItem{}, false
 }
 
 func main() {
-	var interval, qmax int
+	var devlimit, handshakes, interval, qmax, qbytes, retries int
+
+	var expiry, grace, lease, maxwait, rsecs, wsecs float64
 
-	var caddr, maddr, waddr string
+	var aaddr, buckets, caddr, config, maddr, scheduling, waddr string
+
+	var ageing float64
 
 	log.Printf("%s %s", project, version)
+	flag.StringVar(&aaddr, "aaddr", "", "Address to listen for queue admin requests (empty=disabled)")
+	flag.StringVar(&buckets, "buckets", defBuckets, "Comma separated upper bounds for queue time histogram buckets, in seconds")
+	flag.IntVar(&devlimit, "device-metrics", 0, "Max number of per-queue, node + device metric label sets, including overflow one (0=disabled)")
 	flag.StringVar(&caddr, "caddr", "localhost:9997", "Address to listen for client service requests")
+	flag.StringVar(&config, "config", "", "YAML / JSON file with per-queue policies, reloaded on SIGHUP")
 	flag.IntVar(&interval, "interval", 0, "Log queue statistics at given interval in seconds (0=disabled)")
 	flag.StringVar(&maddr, "maddr", "localhost:9998", "Address to listen for Prometheus metric queries")
 	flag.StringVar(&waddr, "waddr", "localhost:9999", "Address to listen for worker work item requests")
+	flag.Float64Var(&expiry, "worker-expiry", 300, "Drop workers from registry after not seeing them for given seconds (0=never)")
+	flag.Float64Var(&grace, "grace", 30, "Max time in seconds to wait for running items to finish on shutdown")
+	flag.Float64Var(&lease, "lease", 0, "Max time in seconds for worker to reply before its item is requeued (0=unlimited)")
+	flag.Float64Var(&maxwait, "max-wait", 30, "Max time in seconds worker can wait for an item when queue is empty")
+	flag.IntVar(&retries, "retries", 2, "Max times work item is requeued after its delivery to a worker fails")
 	flag.IntVar(&qmax, "qmax", 0, "Max queue size after which requests are denied (0=unlimited)")
+	flag.IntVar(&qbytes, "qmax-bytes", 0, "Max approximate queue memory usage in bytes after which requests are denied (0=unlimited)")
+	flag.StringVar(&scheduling, "scheduling", defScheduling, "Queue scheduling policy ("+schedulerNames()+")")
+	flag.Float64Var(&ageing, "ageing", 10, "Raise priority of waiting items by one after each given number of seconds (0=never)")
+	flag.IntVar(&msgmax, "msg-max", protocol.DefaultMaxSize, "Max size for client and worker messages, in bytes")
+	flag.IntVar(&handshakes, "handshakes", 64, "Max number of connections concurrently in request handshake, separately for client and worker ports")
+	flag.Float64Var(&rsecs, "read-timeout", 5, "Deadline for reading client and worker requests in seconds (0=none)")
+	flag.Float64Var(&wsecs, "write-timeout", 5, "Deadline for writing client and worker replies in seconds (0=none)")
 	flag.BoolVar(&verbose, "verbose", false, "Log all messages")
 	flag.Parse()
 
+	if msgmax < protocol.MinMaxSize {
+		log.Fatalf("ERROR: too small message size limit (%d < %d)", msgmax, protocol.MinMaxSize)
+	}
+
+	if rsecs < 0 || wsecs < 0 {
+		log.Fatalf("ERROR: invalid read/write timeout values (0 <= %.1f, 0 <= %.1f)", rsecs, wsecs)
+	}
+
+	rtimeout = time.Duration(uint64(1000*rsecs)) * time.Millisecond
+	wtimeout = time.Duration(uint64(1000*wsecs)) * time.Millisecond
+
+	if lease < 0 || maxwait < 0 || retries < 0 {
+		log.Fatalf("ERROR: invalid lease/max-wait/retries values (0 <= %.1f, 0 <= %.1f, 0 <= %d)", lease, maxwait, retries)
+	}
+
+	if expiry < 0 || grace < 0 {
+		log.Fatalf("ERROR: invalid worker expiry/grace values (0 <= %.1f, 0 <= %.1f)", expiry, grace)
+	}
+
+	if devlimit < 0 {
+		log.Fatalf("ERROR: invalid device metrics limit (0 <= %d)", devlimit)
+	}
+
+	if handshakes < 1 {
+		log.Fatalf("ERROR: invalid concurrent handshakes limit (%d < 1)", handshakes)
+	}
+
+	bounds, err := parseBuckets(buckets)
+	if err != nil {
+		log.Fatalf("ERROR: invalid histogram buckets: %v", err)
+	}
+
 	names := flag.Args()
-	if len(names) == 0 {
-		log.Fatal("ERROR: no queue names specified (as arguments)")
+	if len(names) == 0 && config == "" {
+		log.Fatal("ERROR: no queue names specified (as arguments or in config file)")
 	}
 
-	// use fixed set of queue names
-	queues := queuesT{maps: make(map[string]*queueT), interval: interval}
+	// initial set of queues, settings are used also for
+	// queues added later on through admin API
+	queues := queuesT{
+		maps: make(map[string]*queueT),
+		settings: queueSettingsT{
+			lease:   time.Duration(uint64(1000*lease)) * time.Millisecond,
+			wait:    time.Duration(uint64(1000*maxwait)) * time.Millisecond,
+			retries: retries,
+			bounds:  bounds,
+			grace:   time.Duration(uint64(1000*grace)) * time.Millisecond,
+			policy:  policyT{MaxLength: qmax, MaxBytes: qbytes, Scheduling: scheduling, Ageing: ageing},
+		},
+		configured:  make(map[string]bool),
+		chandshakes: make(handshakesT, handshakes),
+		whandshakes: make(handshakesT, handshakes),
+		devices:     newDeviceStats(devlimit, bounds),
+		registry:    newRegistry(time.Duration(uint64(1000*expiry)) * time.Millisecond),
+		interval:    interval,
+	}
 
-	for _, name := range names {
-		if name == "" {
-			log.Fatal("ERROR: invalid queue name ''")
-		}
+	if err = queues.settings.policy.compile(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
 
-		queues.maps[name] = &queueT{
-			mutex: sync.Mutex{},
-			items: make([]queueItem, 0, qmax),
+	for _, name := range names {
+		if err = queues.create(name, &queues.settings.policy); err != nil {
+			log.Fatalf("ERROR: %v", err)
 		}
 	}
 
 	log.Printf("Added queues: %v", names)
 
+	if config != "" {
+		if err = queues.loadConfig(config); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+	}
+
 	// Go routines for handling input
-	go queues.listenForClients(caddr, qmax)
+	go queues.listenForClients(caddr)
 	go queues.listenForWorkers(waddr)
 	go listenPrometheus(maddr, &queues)
 
+	if aaddr != "" {
+		go listenAdmin(aaddr, &queues)
+	}
+
 	// and automated stats logging
 	if queues.interval > 0 {
 		go queues.logStats()
 	}
 
-	// exit with 0 when asked nicely to terminate
+	// and expiring items which waited too long
+	go queues.expireItems(time.Second)
+
+	// reload config on SIGHUP, if there's one, and shut down
+	// gracefully when asked nicely to terminate, or immediately
+	// if asked again
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	log.Printf("Got signal %d => terminating", <-sig)
-	os.Exit(0)
+
+	for s := range sig {
+		if s == syscall.SIGHUP && config != "" {
+			log.Printf("Got signal %d => reloading '%s'", s, config)
+
+			if err = queues.loadConfig(config); err != nil {
+				log.Printf("WARN: config reload failed, keeping earlier one: %v", err)
+			}
+
+			continue
+		}
+
+		if queues.startShutdown() {
+			log.Printf("Got signal %d => shutting down", s)
+			go queues.shutdown()
+
+			continue
+		}
+
+		log.Printf("Got signal %d while shutting down => terminating", s)
+		os.Exit(0)
+	}
 }
@@ -0,0 +1,355 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// default histogram bucket upper bounds, in seconds.
+const defBuckets = "0.1,0.25,0.5,1,2.5,5,10,25,50,100"
+
+var errBucketOrder = errors.New("histogram bucket bounds not increasing")
+
+// histogramT is a cumulative Prometheus histogram.
+type histogramT struct {
+	bounds []float64 // bucket upper bounds, shared, not modified
+	counts []uint64  // per-bucket (non-cumulative) counts, last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// parseBuckets parses comma separated list of increasing
+// histogram bucket upper bounds.
+func parseBuckets(list string) ([]float64, error) {
+	fields := strings.Split(list, ",")
+	bounds := make([]float64, 0, len(fields))
+
+	for _, field := range fields {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket value '%s': %w", field, err)
+		}
+
+		if len(bounds) > 0 && value <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("%w: %g <= %g", errBucketOrder, value, bounds[len(bounds)-1])
+		}
+
+		bounds = append(bounds, value)
+	}
+
+	return bounds, nil
+}
+
+// newHistogram returns histogram using given bucket bounds.
+func newHistogram(bounds []float64) *histogramT {
+	return &histogramT{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// observe adds given value to histogram.
+func (h *histogramT) observe(value float64) {
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// clone returns copy of the histogram.
+func (h *histogramT) clone() *histogramT {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+
+	return &c
+}
+
+// priorityHist returns wait time histogram for given item priority,
+// creating it if needed. Must be called with queue.mutex held.
+func (queue *queueT) priorityHist(priority int) *histogramT {
+	hist, exists := queue.priohist[priority]
+	if !exists {
+		hist = newHistogram(queue.waithist.bounds)
+		queue.priohist[priority] = hist
+	}
+
+	return hist
+}
+
+// priorityStatsT is snapshot of queue wait time histogram for one priority.
+type priorityStatsT struct {
+	priority int
+	waithist *histogramT
+}
+
+// oldestWait returns wait time for the oldest item in the queue, in seconds.
+// Must be called with queue.mutex held.
+func (queue *queueT) oldestWait(now time.Time) float64 {
+	if queue.items.len() == 0 {
+		return 0
+	}
+
+	oldest := queue.items.at(0).added
+	for i := 1; i < queue.items.len(); i++ {
+		if added := queue.items.at(i).added; added.Before(oldest) {
+			oldest = added
+		}
+	}
+
+	return now.Sub(oldest).Seconds()
+}
+
+// requestCheck checks that request is GET without body, for given path.
+func requestCheck(r *http.Request, path string) int {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed
+	}
+
+	if r.URL.Path != path {
+		return http.StatusNotFound
+	}
+
+	if r.Body != http.NoBody {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusOK
+}
+
+// queueStatsT is a snapshot of queue metrics, taken for exporting.
+type queueStatsT struct {
+	name                              string
+	waiting, running, idle            uint64
+	waitbytes                         uint64
+	disconnect, expired, requeued     uint64
+	canceled                          uint64
+	success, failure                  uint64
+	oldest, maxrun, maxwait, maxtotal float64
+	waithist, runhist, totalhist      *histogramT
+	// sorted by priority
+	priorities []priorityStatsT
+}
+
+// snapshot returns sorted queue metrics snapshot, and resets max times
+// unless stats logging + reset interval is enabled.
+func (queues *queuesT) snapshot() []queueStatsT {
+	now := time.Now()
+	list := queues.list()
+	stats := make([]queueStatsT, 0, len(list))
+
+	for _, q := range list {
+		q.mutex.Lock()
+
+		priorities := make([]priorityStatsT, 0, len(q.priohist))
+		for priority, hist := range q.priohist {
+			priorities = append(priorities, priorityStatsT{priority: priority, waithist: hist.clone()})
+		}
+
+		sort.Slice(priorities, func(i, j int) bool {
+			return priorities[i].priority < priorities[j].priority
+		})
+
+		stats = append(stats, queueStatsT{
+			name:       q.name,
+			waiting:    uint64(q.items.len()),
+			waitbytes:  uint64(q.items.size()),
+			running:    uint64(q.running),
+			idle:       uint64(len(q.waiters)),
+			disconnect: q.disconnect,
+			expired:    q.expired,
+			canceled:   q.canceled,
+			requeued:   q.requeued,
+			success:    q.success,
+			failure:    q.failure,
+			oldest:     q.oldestWait(now),
+			maxrun:     q.maxrun,
+			maxwait:    q.maxwait,
+			maxtotal:   q.maxtotal,
+			waithist:   q.waithist.clone(),
+			runhist:    q.runhist.clone(),
+			totalhist:  q.totalhist.clone(),
+			priorities: priorities,
+		})
+
+		if queues.interval <= 0 {
+			q.maxrun, q.maxwait, q.maxtotal = 0, 0, 0
+		}
+
+		q.mutex.Unlock()
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].name < stats[j].name
+	})
+
+	return stats
+}
+
+// queueLabels returns exposition labels for given queue.
+func queueLabels(name string) string {
+	return labels("name", name)
+}
+
+// writeQueueCounts writes given queue count metric for all queues.
+func writeQueueCounts(mw *metricWriter, stats []queueStatsT, name, mtype, help string, value func(*queueStatsT) uint64) {
+	mw.family(name, mtype, help)
+
+	for i := range stats {
+		mw.sample(name, queueLabels(stats[i].name), value(&stats[i]))
+	}
+}
+
+// writeQueueHistograms writes given queue histogram for all queues.
+func writeQueueHistograms(mw *metricWriter, stats []queueStatsT, name, help string, hist func(*queueStatsT) *histogramT) {
+	mw.family(name, histogramType, help)
+
+	for i := range stats {
+		mw.histogram(name, queueLabels(stats[i].name), hist(&stats[i]))
+	}
+}
+
+// writeQueueMaxTimes writes given queue max time metric for all queues.
+func (queues *queuesT) writeQueueMaxTimes(mw *metricWriter, stats []queueStatsT, name, help string, value func(*queueStatsT) float64) {
+	mw.family(name, gaugeType, help)
+
+	for i := range stats {
+		var labelset string
+		if queues.interval > 0 {
+			labelset = labels("name", stats[i].name, "interval", fmt.Sprintf("%ds", queues.interval))
+		} else {
+			labelset = queueLabels(stats[i].name)
+		}
+
+		mw.sampleFloat(name, labelset, value(&stats[i]))
+	}
+}
+
+// exporter reports queue statistics as Prometheus metrics, in Prometheus
+// text or OpenMetrics format, based on the request Accept header.
+// Resets max times on each query unless stats logging + reset
+// interval is enabled.
+func (queues *queuesT) exporter(w http.ResponseWriter, r *http.Request) {
+	if status := requestCheck(r, metricURL); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	if verbose {
+		log.Printf("metrics query from '%s'", r.RemoteAddr)
+	}
+
+	mw := newMetricWriter(w, r)
+
+	mw.family("hpa_frontend_build_info", infoType, "Frontend build information, value is always 1.")
+	mw.sample("hpa_frontend_build_info", labels("version", version, "goversion", runtime.Version(),
+		"protocol", strconv.Itoa(protocol.Version)), 1)
+
+	queues.mutex.Lock()
+	counts := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"hpa_client_connections_total", "Client connections accepted.", queues.clients},
+		{"hpa_worker_connections_total", "Worker connections accepted.", queues.workers},
+		{"hpa_client_handshake_timeouts_total", "Client connections timed out before completing their request.", queues.ctimeouts},
+		{"hpa_worker_handshake_timeouts_total", "Worker connections timed out before completing their request.", queues.wtimeouts},
+	}
+	queues.metrics++
+	queues.mutex.Unlock()
+
+	for _, count := range counts {
+		mw.family(count.name, counterType, count.help)
+		mw.sample(count.name, "", count.value)
+	}
+
+	// report results and reset max timer
+	stats := queues.snapshot()
+
+	writeQueueCounts(mw, stats, "hpa_queue_all", gaugeType, "Items waiting in queue or being processed.",
+		func(s *queueStatsT) uint64 { return s.waiting + s.running })
+	writeQueueCounts(mw, stats, "hpa_queue_waiting", gaugeType, "Items waiting in queue.",
+		func(s *queueStatsT) uint64 { return s.waiting })
+	writeQueueCounts(mw, stats, "hpa_queue_waiting_bytes", gaugeType, "Approximate memory usage of items waiting in queue.",
+		func(s *queueStatsT) uint64 { return s.waitbytes })
+	writeQueueCounts(mw, stats, "hpa_queue_running", gaugeType, "Items being processed by workers.",
+		func(s *queueStatsT) uint64 { return s.running })
+	writeQueueCounts(mw, stats, "hpa_queue_idle_workers", gaugeType, "Workers waiting for items.",
+		func(s *queueStatsT) uint64 { return s.idle })
+	writeQueueCounts(mw, stats, "hpa_queue_success_total", counterType, "Items processed successfully.",
+		func(s *queueStatsT) uint64 { return s.success })
+	writeQueueCounts(mw, stats, "hpa_queue_failure_total", counterType, "Items whose processing failed.",
+		func(s *queueStatsT) uint64 { return s.failure })
+	writeQueueCounts(mw, stats, "hpa_queue_disconnect_total", counterType, "Items discarded due to client disconnect.",
+		func(s *queueStatsT) uint64 { return s.disconnect })
+	writeQueueCounts(mw, stats, "hpa_queue_expired_total", counterType, "Items discarded due to waiting in queue longer than allowed.",
+		func(s *queueStatsT) uint64 { return s.expired })
+	writeQueueCounts(mw, stats, "hpa_queue_canceled_total", counterType, "Running items canceled due to client disconnect.",
+		func(s *queueStatsT) uint64 { return s.canceled })
+	writeQueueCounts(mw, stats, "hpa_queue_requeued_total", counterType, "Items requeued after failed delivery to worker.",
+		func(s *queueStatsT) uint64 { return s.requeued })
+
+	mw.family("hpa_queue_oldest_wait_seconds", gaugeType, "Wait time of the oldest item in queue.")
+
+	for i := range stats {
+		mw.sampleFloat("hpa_queue_oldest_wait_seconds", queueLabels(stats[i].name), stats[i].oldest)
+	}
+
+	writeQueueHistograms(mw, stats, "hpa_queue_wait_seconds", "Item wait times in queue.",
+		func(s *queueStatsT) *histogramT { return s.waithist })
+	writeQueueHistograms(mw, stats, "hpa_queue_run_seconds", "Item run times in workers.",
+		func(s *queueStatsT) *histogramT { return s.runhist })
+	writeQueueHistograms(mw, stats, "hpa_queue_total_seconds", "Item total wait + run times.",
+		func(s *queueStatsT) *histogramT { return s.totalhist })
+
+	mw.family("hpa_queue_priority_wait_seconds", histogramType, "Item wait times in queue, per item priority.")
+
+	for i := range stats {
+		for _, p := range stats[i].priorities {
+			mw.histogram("hpa_queue_priority_wait_seconds",
+				labels("name", stats[i].name, "priority", strconv.Itoa(p.priority)), p.waithist)
+		}
+	}
+
+	queues.writeQueueMaxTimes(mw, stats, "hpa_queue_maxrun_seconds", "Max item run time since previous reset.",
+		func(s *queueStatsT) float64 { return s.maxrun })
+	queues.writeQueueMaxTimes(mw, stats, "hpa_queue_maxwait_seconds", "Max item wait time since previous reset.",
+		func(s *queueStatsT) float64 { return s.maxwait })
+	queues.writeQueueMaxTimes(mw, stats, "hpa_queue_maxtotal_seconds", "Max item total time since previous reset.",
+		func(s *queueStatsT) float64 { return s.maxtotal })
+
+	queues.devices.export(mw)
+	queues.registry.export(mw)
+
+	mw.end()
+}
+
+func listenPrometheus(addr string, queues *queuesT) {
+	// Set both header and whole message timeout to same value
+	// as handler rejects HTTP queries with a body
+	server := &http.Server{
+		Addr:              addr,
+		ReadTimeout:       time.Second,
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    4096,
+	}
+
+	http.HandleFunc(metricURL, queues.exporter)
+	http.HandleFunc(workersURL, queues.registry.lister)
+	log.Printf("Listening queue metric queries on %s%s, and worker list queries on %s%s", addr, metricURL, addr, workersURL)
+	log.Fatal(server.ListenAndServe())
+}
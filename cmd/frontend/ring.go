@@ -0,0 +1,218 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+// min ring buffer capacity, it's not shrunk below this.
+const minRing = 16
+
+// approximate memory overhead of a queued item, in addition to its
+// request content, including its client connection state.
+const itemOverhead = 512
+
+// itemQueueT is a ring buffer deque for queue items, with O(1) push and
+// pop at both ends, and removal from middle which moves only the items
+// on the shorter side of the removed one. Buffer grows and shrinks with
+// item count, and removed slots are cleared, so that no references to
+// removed items (and their connections) remain. Zero value is an empty
+// queue.
+type itemQueueT struct {
+	buf   []queueItem
+	head  int
+	count int
+	// approximate memory usage of the items, in bytes
+	bytes int
+	// number of items with a selector or priority
+	special int
+}
+
+// itemSize returns approximate memory usage of given item.
+func itemSize(item *queueItem) int {
+	size := itemOverhead + len(item.owner) + len(item.id)
+
+	for _, arg := range item.Args {
+		size += len(arg)
+	}
+
+	for i := range item.selector {
+		size += len(item.selector[i].Key) + len(item.selector[i].Value)
+	}
+
+	return size
+}
+
+// isSpecial returns true if given item has a selector or priority,
+// i.e. it cannot be scheduled just by its queue position.
+func isSpecial(item *queueItem) bool {
+	return len(item.selector) > 0 || item.priority != 0
+}
+
+// account adds (sign=1) or removes (sign=-1) given item from queue
+// memory usage and special item count, and updates its queued state.
+func (q *itemQueueT) account(item *queueItem, sign int) {
+	q.bytes += sign * itemSize(item)
+
+	if item.queued != nil {
+		*item.queued = sign > 0
+	}
+
+	if isSpecial(item) {
+		q.special += sign
+	}
+}
+
+// len returns number of items in the queue.
+func (q *itemQueueT) len() int {
+	return q.count
+}
+
+// size returns approximate memory usage of the queued items, in bytes.
+func (q *itemQueueT) size() int {
+	return q.bytes
+}
+
+// plain returns true if queue has no items with selector or priority.
+func (q *itemQueueT) plain() bool {
+	return q.special == 0
+}
+
+// index returns buffer index for given queue position.
+func (q *itemQueueT) index(i int) int {
+	return (q.head + i) % len(q.buf)
+}
+
+// at returns item at given queue position (0=front).
+func (q *itemQueueT) at(i int) *queueItem {
+	return &q.buf[q.index(i)]
+}
+
+// resize moves items to a new buffer of given capacity.
+func (q *itemQueueT) resize(capacity int) {
+	buf := make([]queueItem, capacity)
+
+	if q.count > 0 {
+		if q.head+q.count <= len(q.buf) {
+			copy(buf, q.buf[q.head:q.head+q.count])
+		} else {
+			n := copy(buf, q.buf[q.head:])
+			copy(buf[n:], q.buf[:q.count-n])
+		}
+	}
+
+	q.buf = buf
+	q.head = 0
+}
+
+// grow makes room for one more item, if needed.
+func (q *itemQueueT) grow() {
+	if q.count < len(q.buf) {
+		return
+	}
+
+	capacity := 2 * len(q.buf)
+	if capacity < minRing {
+		capacity = minRing
+	}
+
+	q.resize(capacity)
+}
+
+// shrink releases memory when buffer is mostly empty.
+func (q *itemQueueT) shrink() {
+	capacity := len(q.buf)
+	for capacity > minRing && q.count <= capacity/4 {
+		capacity /= 2
+	}
+
+	if capacity < len(q.buf) {
+		q.resize(capacity)
+	}
+}
+
+// pushBack adds given item to queue back.
+func (q *itemQueueT) pushBack(item queueItem) {
+	q.grow()
+	q.buf[q.index(q.count)] = item
+	q.count++
+	q.account(&item, 1)
+}
+
+// pushFront adds given item to queue front.
+func (q *itemQueueT) pushFront(item queueItem) {
+	q.grow()
+	q.head = (q.head + len(q.buf) - 1) % len(q.buf)
+	q.buf[q.head] = item
+	q.count++
+	q.account(&item, 1)
+}
+
+// remove removes and returns item at given queue position.
+func (q *itemQueueT) remove(i int) queueItem {
+	item := *q.at(i)
+
+	if i < q.count/2 {
+		// move items before removed one towards back
+		for j := i; j > 0; j-- {
+			q.buf[q.index(j)] = q.buf[q.index(j-1)]
+		}
+
+		q.buf[q.head] = queueItem{}
+		q.head = (q.head + 1) % len(q.buf)
+	} else {
+		// move items after removed one towards front
+		for j := i; j < q.count-1; j++ {
+			q.buf[q.index(j)] = q.buf[q.index(j+1)]
+		}
+
+		q.buf[q.index(q.count-1)] = queueItem{}
+	}
+
+	q.count--
+	q.account(&item, -1)
+	q.shrink()
+
+	return item
+}
+
+// filter removes items for which given function returns false,
+// keeping the order of the rest.
+func (q *itemQueueT) filter(keep func(*queueItem) bool) {
+	kept := 0
+
+	for i := 0; i < q.count; i++ {
+		item := q.at(i)
+		if !keep(item) {
+			q.account(item, -1)
+			continue
+		}
+
+		if kept != i {
+			*q.at(kept) = *item
+		}
+
+		kept++
+	}
+
+	for i := kept; i < q.count; i++ {
+		*q.at(i) = queueItem{}
+	}
+
+	q.count = kept
+	q.shrink()
+}
+
+// clear removes all items and returns them.
+func (q *itemQueueT) clear() []queueItem {
+	items := make([]queueItem, 0, q.count)
+	for i := 0; i < q.count; i++ {
+		item := q.at(i)
+		if item.queued != nil {
+			*item.queued = false
+		}
+
+		items = append(items, *item)
+	}
+
+	*q = itemQueueT{}
+
+	return items
+}
@@ -0,0 +1,420 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// testItem returns queue item with given ID.
+func testItem(id int) queueItem {
+	return queueItem{id: fmt.Sprint(id), owner: "host"}
+}
+
+// checkOrder fails given test if queue items do not have given IDs,
+// in given order.
+func checkOrder(t *testing.T, q *itemQueueT, ids ...int) {
+	t.Helper()
+
+	if q.len() != len(ids) {
+		t.Fatalf("queue length = %d, want %d", q.len(), len(ids))
+	}
+
+	for i, id := range ids {
+		if got := q.at(i).id; got != fmt.Sprint(id) {
+			t.Fatalf("item %d ID = %s, want %d", i, got, id)
+		}
+	}
+}
+
+func TestRingWrapAround(t *testing.T) {
+	q := itemQueueT{}
+
+	// move head to buffer middle, so that items wrap over buffer end
+	for i := 0; i < minRing; i++ {
+		q.pushBack(testItem(-1))
+	}
+
+	for i := 0; i < minRing/2; i++ {
+		q.remove(0)
+	}
+
+	for i := 0; i < minRing/2; i++ {
+		q.pushBack(testItem(i))
+	}
+
+	if q.head == 0 || len(q.buf) != minRing {
+		t.Fatalf("head = %d, capacity = %d, want wrapped buffer of %d", q.head, len(q.buf), minRing)
+	}
+
+	for i := 0; i < minRing/2; i++ {
+		q.remove(0)
+	}
+
+	want := make([]int, 0, minRing/2)
+	for i := 0; i < minRing/2; i++ {
+		want = append(want, i)
+	}
+
+	checkOrder(t, &q, want...)
+
+	// growing wrapped buffer keeps the order
+	for i := minRing / 2; i < 2*minRing; i++ {
+		q.pushBack(testItem(i))
+		want = append(want, i)
+	}
+
+	checkOrder(t, &q, want...)
+}
+
+func TestRingPushFront(t *testing.T) {
+	q := itemQueueT{}
+
+	q.pushBack(testItem(2))
+	q.pushFront(testItem(1))
+	q.pushBack(testItem(3))
+	q.pushFront(testItem(0))
+
+	checkOrder(t, &q, 0, 1, 2, 3)
+
+	// pushing to front of an empty queue wraps head to buffer end
+	q = itemQueueT{}
+	for i := minRing + 1; i >= 0; i-- {
+		q.pushFront(testItem(i))
+	}
+
+	want := make([]int, 0, minRing+2)
+	for i := 0; i <= minRing+1; i++ {
+		want = append(want, i)
+	}
+
+	checkOrder(t, &q, want...)
+}
+
+func TestRingRemove(t *testing.T) {
+	tests := []struct {
+		name string
+		idx  int
+		want []int
+	}{
+		{"front", 0, []int{1, 2, 3, 4, 5, 6, 7}},
+		{"front side", 2, []int{0, 1, 3, 4, 5, 6, 7}},
+		{"back side", 5, []int{0, 1, 2, 3, 4, 6, 7}},
+		{"back", 7, []int{0, 1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := itemQueueT{}
+
+			// start from buffer end, so that removals move items over it
+			for i := 7; i >= 0; i-- {
+				q.pushFront(testItem(i))
+			}
+
+			item := q.remove(tt.idx)
+			if item.id != fmt.Sprint(tt.idx) {
+				t.Fatalf("remove(%d) = item %s", tt.idx, item.id)
+			}
+
+			checkOrder(t, &q, tt.want...)
+
+			// removed slot is cleared
+			for i := range q.buf {
+				if q.buf[i].id == "" {
+					continue
+				}
+
+				inQueue := false
+				for j := 0; j < q.len(); j++ {
+					inQueue = inQueue || q.index(j) == i
+				}
+
+				if !inQueue {
+					t.Fatalf("slot %d outside queue not cleared: item %s", i, q.buf[i].id)
+				}
+			}
+		})
+	}
+}
+
+func TestRingFilter(t *testing.T) {
+	q := itemQueueT{}
+	for i := 0; i < 10; i++ {
+		q.pushBack(testItem(i))
+	}
+
+	even := map[string]bool{}
+	for i := 0; i < 10; i += 2 {
+		even[fmt.Sprint(i)] = true
+	}
+
+	q.filter(func(item *queueItem) bool {
+		return even[item.id]
+	})
+
+	checkOrder(t, &q, 0, 2, 4, 6, 8)
+
+	for i := q.len(); i < len(q.buf); i++ {
+		if item := q.buf[q.index(i)]; item.id != "" {
+			t.Fatalf("filtered slot not cleared: item %s", item.id)
+		}
+	}
+
+	q.filter(func(*queueItem) bool { return false })
+	checkOrder(t, &q)
+}
+
+func TestRingShrink(t *testing.T) {
+	q := itemQueueT{}
+
+	const count = 8 * minRing
+	for i := 0; i < count; i++ {
+		q.pushBack(testItem(i))
+	}
+
+	if len(q.buf) < count {
+		t.Fatalf("capacity = %d, want at least %d", len(q.buf), count)
+	}
+
+	for i := 0; i < count-1; i++ {
+		q.remove(0)
+
+		if q.len() > minRing && q.len() < len(q.buf)/8 {
+			t.Fatalf("capacity %d not shrunk for %d items", len(q.buf), q.len())
+		}
+	}
+
+	if len(q.buf) != minRing {
+		t.Fatalf("capacity = %d, want %d", len(q.buf), minRing)
+	}
+
+	checkOrder(t, &q, count-1)
+}
+
+func TestRingAccounting(t *testing.T) {
+	q := itemQueueT{}
+
+	items := []queueItem{
+		testItem(0),
+		{id: "args", Args: []string{"foo", "bar"}},
+		{id: "selector", selector: []protocol.Requirement{{Key: "gpu", Value: "i915"}}},
+		{id: "priority", priority: 1},
+	}
+
+	total := 0
+	for i := range items {
+		total += itemSize(&items[i])
+		q.pushBack(items[i])
+	}
+
+	if want := 4*itemOverhead + len("0host") + len("argsfoobar") + len("selectorgpui915") + len("priority"); total != want {
+		t.Fatalf("item sizes = %d, want %d", total, want)
+	}
+
+	if q.size() != total || q.plain() {
+		t.Fatalf("size = %d, plain = %v, want %d, false", q.size(), q.plain(), total)
+	}
+
+	// remove item with selector
+	q.remove(2)
+
+	if q.size() != total-itemSize(&items[2]) || q.plain() {
+		t.Fatalf("size = %d, plain = %v after removal", q.size(), q.plain())
+	}
+
+	// filter out item with priority
+	q.filter(func(item *queueItem) bool {
+		return item.priority == 0
+	})
+
+	if !q.plain() {
+		t.Fatal("queue without selectors and priorities is not plain")
+	}
+
+	q.pushFront(items[3])
+	q.remove(0)
+	q.remove(q.len() - 1)
+	q.remove(0)
+
+	if q.size() != 0 || !q.plain() || q.len() != 0 {
+		t.Fatalf("empty queue size = %d, plain = %v, length = %d", q.size(), q.plain(), q.len())
+	}
+
+	q.pushBack(items[1])
+
+	if len(q.clear()) != 1 || q.size() != 0 {
+		t.Fatalf("cleared queue size = %d", q.size())
+	}
+}
+
+func TestRingQueued(t *testing.T) {
+	q := itemQueueT{}
+
+	items := make([]queueItem, 3)
+	for i := range items {
+		items[i] = testItem(i)
+		items[i].queued = new(bool)
+		q.pushBack(items[i])
+	}
+
+	q.remove(1)
+	q.filter(func(item *queueItem) bool { return item.id != "2" })
+
+	if !*items[0].queued || *items[1].queued || *items[2].queued {
+		t.Fatalf("queued = %v, %v, %v, want true, false, false", *items[0].queued, *items[1].queued, *items[2].queued)
+	}
+
+	q.pushFront(items[1])
+	q.clear()
+
+	if *items[0].queued || *items[1].queued {
+		t.Fatal("cleared items still queued")
+	}
+}
+
+func TestTakeItemFIFO(t *testing.T) {
+	queue := &queueT{policy: policyT{Scheduling: "fifo", scheduler: scheduleFIFO}}
+
+	for i := 0; i < 4; i++ {
+		queue.items.pushBack(testItem(i))
+	}
+
+	// requeued item goes first
+	requeued := testItem(9)
+	requeued.retries = 1
+	queue.items.pushFront(requeued)
+
+	// higher priority item goes before other new items
+	priority := testItem(8)
+	priority.priority = 1
+	queue.items.pushBack(priority)
+
+	for _, want := range []string{"9", "8", "0", "1", "2", "3"} {
+		item, ok := queue.takeItem(nil)
+		if !ok || item.id != want {
+			t.Fatalf("takeItem() = item %s, %v, want item %s", item.id, ok, want)
+		}
+	}
+
+	if _, ok := queue.takeItem(nil); ok {
+		t.Fatal("takeItem() from empty queue succeeded")
+	}
+}
+
+// sliceQueueT is the earlier slice based item queue, for comparison.
+type sliceQueueT struct {
+	items []queueItem
+}
+
+func (q *sliceQueueT) pushBack(item queueItem) {
+	q.items = append(q.items, item)
+}
+
+func (q *sliceQueueT) pushFront(item queueItem) {
+	q.items = append([]queueItem{item}, q.items...)
+}
+
+func (q *sliceQueueT) remove(i int) queueItem {
+	item := q.items[i]
+
+	if i == 0 {
+		q.items = q.items[1:]
+	} else {
+		q.items = append(q.items[:i], q.items[i+1:]...)
+	}
+
+	return item
+}
+
+// benchmark queue lengths.
+var benchLengths = []int{16, 1024, 16384}
+
+func BenchmarkRingFIFO(b *testing.B) {
+	for _, length := range benchLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			q := itemQueueT{}
+			for i := 0; i < length; i++ {
+				q.pushBack(testItem(i))
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				q.pushBack(q.remove(0))
+			}
+		})
+	}
+}
+
+func BenchmarkSliceFIFO(b *testing.B) {
+	for _, length := range benchLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			q := sliceQueueT{}
+			for i := 0; i < length; i++ {
+				q.pushBack(testItem(i))
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				q.pushBack(q.remove(0))
+			}
+		})
+	}
+}
+
+func BenchmarkRingRequeue(b *testing.B) {
+	for _, length := range benchLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			q := itemQueueT{}
+			for i := 0; i < length; i++ {
+				q.pushBack(testItem(i))
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				q.pushFront(q.remove(q.len() - 1))
+			}
+		})
+	}
+}
+
+func BenchmarkSliceRequeue(b *testing.B) {
+	for _, length := range benchLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			q := sliceQueueT{}
+			for i := 0; i < length; i++ {
+				q.pushBack(testItem(i))
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				q.pushFront(q.remove(len(q.items) - 1))
+			}
+		})
+	}
+}
+
+func BenchmarkTakeItemFIFO(b *testing.B) {
+	for _, length := range benchLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			queue := &queueT{policy: policyT{Scheduling: "fifo", scheduler: scheduleFIFO}}
+			for i := 0; i < length; i++ {
+				queue.items.pushBack(testItem(i))
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				item, _ := queue.takeItem(nil)
+				queue.items.pushBack(item)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// default queue scheduling policy.
+const defScheduling = "fifo"
+
+var errScheduling = errors.New("unknown scheduling policy")
+
+// schedulerT returns index of the queue item that should be handed out
+// next, from given candidate item indexes, which are in queue order.
+// Must be called with queue.mutex held.
+type schedulerT func(queue *queueT, candidates []int) int
+
+// queue scheduling policies, by name.
+var schedulers = map[string]schedulerT{
+	"fifo": scheduleFIFO,
+	"lifo": scheduleLIFO,
+	"edf":  scheduleEDF,
+	"fair": scheduleFair,
+}
+
+// schedulerNames returns sorted list of scheduling policy names.
+func schedulerNames() string {
+	names := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// getScheduler returns scheduler for given policy name.
+func getScheduler(name string) (schedulerT, error) {
+	if scheduler, exists := schedulers[name]; exists {
+		return scheduler, nil
+	}
+
+	return nil, fmt.Errorf("%w '%s' (not one of: %s)", errScheduling, name, schedulerNames())
+}
+
+// scheduleFIFO picks the oldest item.
+func scheduleFIFO(_ *queueT, candidates []int) int {
+	return candidates[0]
+}
+
+// scheduleLIFO picks the newest item.
+func scheduleLIFO(_ *queueT, candidates []int) int {
+	return candidates[len(candidates)-1]
+}
+
+// deadline returns item deadline based on its run-time limit,
+// or zero time if item does not have a limit.
+func (item *queueItem) deadline() time.Time {
+	if item.Limit <= 0 {
+		return time.Time{}
+	}
+
+	return item.added.Add(time.Duration(uint64(1000*item.Limit)) * time.Millisecond)
+}
+
+// scheduleEDF picks the item with earliest deadline. Items without
+// deadline are picked in FIFO order after ones with a deadline.
+func scheduleEDF(queue *queueT, candidates []int) int {
+	best := candidates[0]
+	bestline := queue.items.at(best).deadline()
+
+	for _, idx := range candidates[1:] {
+		deadline := queue.items.at(idx).deadline()
+		if deadline.IsZero() {
+			continue
+		}
+
+		if bestline.IsZero() || deadline.Before(bestline) {
+			best, bestline = idx, deadline
+		}
+	}
+
+	return best
+}
+
+// scheduleFair picks the oldest item from the client (host) which was
+// served least recently, so that clients get turns in round-robin.
+func scheduleFair(queue *queueT, candidates []int) int {
+	best := candidates[0]
+	bestserved := queue.served[queue.items.at(best).owner]
+
+	for _, idx := range candidates[1:] {
+		served := queue.served[queue.items.at(idx).owner]
+		if served < bestserved {
+			best, bestserved = idx, served
+		}
+	}
+
+	queue.serial++
+	queue.served[queue.items.at(best).owner] = queue.serial
+
+	// forget clients without items, once there are many of them
+	if len(queue.served) > 2*queue.items.len()+16 {
+		owners := make(map[string]uint64, queue.items.len())
+		for i := 0; i < queue.items.len(); i++ {
+			owner := queue.items.at(i).owner
+			owners[owner] = queue.served[owner]
+		}
+
+		queue.served = owners
+	}
+
+	return best
+}
+
+// clientOwner returns fair scheduling owner ID for given client
+// connection, i.e. its remote host.
+func clientOwner(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// effective returns item priority at given time, raised by one for
+// each ageing period it has waited in queue, so that lower priority
+// items do not starve. Must be called with queue.mutex held.
+func (queue *queueT) effective(item *queueItem, now time.Time) int {
+	if queue.policy.Ageing <= 0 {
+		return item.priority
+	}
+
+	return item.priority + int(now.Sub(item.added).Seconds()/queue.policy.Ageing)
+}
+
+// candidates returns indexes of the items that can be handed out next
+// to worker with given labels: requeued items if there are such,
+// otherwise items with highest effective priority. Only items whose
+// selector matches the labels are considered.
+// Must be called with queue.mutex held.
+func (queue *queueT) candidates(labels map[string]string) []int {
+	var list []int
+
+	now := time.Now()
+	bestRequeued, bestPriority := false, 0
+
+	for i := 0; i < queue.items.len(); i++ {
+		item := queue.items.at(i)
+		if !protocol.MatchesAll(item.selector, labels) {
+			continue
+		}
+
+		requeued := item.retries > 0
+		priority := queue.effective(item, now)
+
+		switch {
+		case list == nil,
+			requeued && !bestRequeued,
+			requeued == bestRequeued && priority > bestPriority:
+			list = []int{i}
+			bestRequeued, bestPriority = requeued, priority
+		case requeued == bestRequeued && priority == bestPriority:
+			list = append(list, i)
+		}
+	}
+
+	return list
+}
+
+// takeItem removes next item for worker with given labels from the
+// queue, according to queue scheduling policy. Items whose clients have
+// disconnected, but which their watchers have not yet removed, are
+// discarded on the way. Returns false if queue has no items for the
+// worker. Must be called with queue.mutex held.
+func (queue *queueT) takeItem(labels map[string]string) (queueItem, bool) {
+	for {
+		item, ok := queue.nextItem(labels)
+		if !ok || !item.isGone() {
+			return item, ok
+		}
+
+		queue.discardGone(&item)
+	}
+}
+
+// nextItem removes next item for worker with given labels from the
+// queue, according to queue scheduling policy. Returns false if queue
+// has no items for the worker. Must be called with queue.mutex held.
+//
+// FIFO queue without selectors, priorities and requeued items (which
+// are added to the front) hands out its front item, the oldest one,
+// without scanning the whole queue.
+func (queue *queueT) nextItem(labels map[string]string) (queueItem, bool) {
+	if queue.policy.Scheduling == "fifo" && queue.items.plain() &&
+		queue.items.len() > 0 && queue.items.at(0).retries == 0 {
+		return queue.items.remove(0), true
+	}
+
+	candidates := queue.candidates(labels)
+	if len(candidates) == 0 {
+		return queueItem{}, false
+	}
+
+	idx := queue.policy.scheduler(queue, candidates)
+
+	return queue.items.remove(idx), true
+}
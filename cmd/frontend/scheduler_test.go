@@ -0,0 +1,187 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// schedItem returns queue item with given ID, owner, age (secs),
+// priority and run-time limit.
+func schedItem(id, owner string, age float64, priority int, limit float64) queueItem {
+	return queueItem{
+		id:       id,
+		owner:    owner,
+		added:    time.Now().Add(-time.Duration(1000*age) * time.Millisecond),
+		priority: priority,
+		Limit:    limit,
+	}
+}
+
+func TestSchedulers(t *testing.T) {
+	requeued := schedItem("requeued", "a", 0, -1, 0)
+	requeued.retries = 1
+
+	gpu := schedItem("gpu", "a", 3, 1, 0)
+	gpu.selector = []protocol.Requirement{{Key: "gpu", Op: "="}}
+
+	tests := []struct {
+		name       string
+		scheduling string
+		ageing     float64
+		labels     map[string]string
+		items      []queueItem
+		want       []string
+	}{
+		{"fifo", "fifo", 0, nil, []queueItem{
+			schedItem("1", "a", 3, 0, 0),
+			schedItem("2", "a", 2, 0, 0),
+			schedItem("3", "a", 1, 0, 0),
+		}, []string{"1", "2", "3"}},
+		{"lifo", "lifo", 0, nil, []queueItem{
+			schedItem("1", "a", 3, 0, 0),
+			schedItem("2", "a", 2, 0, 0),
+			schedItem("3", "a", 1, 0, 0),
+		}, []string{"3", "2", "1"}},
+		{"edf", "edf", 0, nil, []queueItem{
+			schedItem("none", "a", 3, 0, 0),
+			schedItem("late", "a", 2, 0, 10),
+			schedItem("early", "a", 1, 0, 2),
+			schedItem("none2", "a", 0, 0, 0),
+		}, []string{"early", "late", "none", "none2"}},
+		{"fair", "fair", 0, nil, []queueItem{
+			schedItem("a1", "a", 4, 0, 0),
+			schedItem("a2", "a", 3, 0, 0),
+			schedItem("a3", "a", 2, 0, 0),
+			schedItem("b1", "b", 1, 0, 0),
+		}, []string{"a1", "b1", "a2", "a3"}},
+		{"priority", "fifo", 0, nil, []queueItem{
+			schedItem("low", "a", 3, -1, 0),
+			schedItem("normal", "a", 2, 0, 0),
+			schedItem("high", "a", 1, 2, 0),
+		}, []string{"high", "normal", "low"}},
+		{"priority lifo", "lifo", 0, nil, []queueItem{
+			schedItem("high1", "a", 3, 1, 0),
+			schedItem("high2", "a", 2, 1, 0),
+			schedItem("low", "a", 1, 0, 0),
+		}, []string{"high2", "high1", "low"}},
+		{"requeued first", "fifo", 0, nil, []queueItem{
+			schedItem("high", "a", 1, 2, 0),
+			requeued,
+		}, []string{"requeued", "high"}},
+		{"ageing", "fifo", 1, nil, []queueItem{
+			schedItem("old", "a", 5.5, 0, 0),
+			schedItem("new", "a", 0, 2, 0),
+		}, []string{"old", "new"}},
+		{"ageing tie", "fifo", 1, nil, []queueItem{
+			schedItem("new", "a", 0, 2, 0),
+			schedItem("old", "a", 2.5, 0, 0),
+		}, []string{"new", "old"}},
+		{"selector mismatch", "fifo", 0, nil, []queueItem{
+			gpu,
+			schedItem("any", "a", 1, 0, 0),
+		}, []string{"any"}},
+		{"selector match", "fifo", 0, map[string]string{"gpu": ""}, []queueItem{
+			schedItem("any", "a", 4, 0, 0),
+			gpu,
+		}, []string{"gpu", "any"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler, err := getScheduler(tt.scheduling)
+			if err != nil {
+				t.Fatalf("getScheduler(%q) unexpected error: %v", tt.scheduling, err)
+			}
+
+			queue := &queueT{
+				policy: policyT{Scheduling: tt.scheduling, scheduler: scheduler, Ageing: tt.ageing},
+				served: make(map[string]uint64),
+			}
+
+			for _, item := range tt.items {
+				queue.items.pushBack(item)
+			}
+
+			for _, want := range tt.want {
+				item, ok := queue.takeItem(tt.labels)
+				if !ok || item.id != want {
+					t.Fatalf("takeItem() = item %q, %v, want item %q", item.id, ok, want)
+				}
+			}
+
+			if item, ok := queue.takeItem(tt.labels); ok {
+				t.Fatalf("takeItem() = item %q, want none", item.id)
+			}
+		})
+	}
+}
+
+func TestEffective(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority int
+		ageing   float64
+		age      float64
+		want     int
+	}{
+		{"no ageing", 1, 0, 100, 1},
+		{"not yet aged", 1, 10, 5, 1},
+		{"aged once", 1, 10, 15, 2},
+		{"aged many times", -2, 0.5, 2.2, 2},
+	}
+
+	now := time.Now()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &queueT{policy: policyT{Ageing: tt.ageing}}
+			item := &queueItem{priority: tt.priority, added: now.Add(-time.Duration(1000*tt.age) * time.Millisecond)}
+
+			if got := queue.effective(item, now); got != tt.want {
+				t.Fatalf("effective() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetScheduler(t *testing.T) {
+	for name := range schedulers {
+		if _, err := getScheduler(name); err != nil {
+			t.Fatalf("getScheduler(%q) unexpected error: %v", name, err)
+		}
+	}
+
+	if _, err := getScheduler("random"); !errors.Is(err, errScheduling) {
+		t.Fatalf("getScheduler(\"random\") error = %v, want %v", err, errScheduling)
+	}
+}
+
+func TestTakeItemGone(t *testing.T) {
+	queue := &queueT{policy: policyT{Scheduling: "fifo", scheduler: scheduleFIFO}}
+
+	for i := 0; i < 3; i++ {
+		item := testItem(i)
+		item.gone = make(chan struct{})
+		item.client, _ = net.Pipe()
+		queue.items.pushBack(item)
+	}
+
+	// first two clients disconnected, but their items are still queued
+	close(queue.items.at(0).gone)
+	close(queue.items.at(1).gone)
+
+	item, ok := queue.takeItem(nil)
+	if !ok || item.id != "2" {
+		t.Fatalf("takeItem() = item %s, %v, want item 2", item.id, ok)
+	}
+
+	if queue.disconnect != 2 || queue.items.len() != 0 {
+		t.Fatalf("disconnects = %d, items = %d, want 2, 0", queue.disconnect, queue.items.len())
+	}
+}
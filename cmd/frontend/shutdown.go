@@ -0,0 +1,87 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// how often running items are checked during shutdown.
+const shutdownPoll = 100 * time.Millisecond
+
+var errShutdown = errors.New("frontend is shutting down")
+
+// startShutdown marks frontend as shutting down, so that no new queues
+// are created. Returns false if shutdown was already started.
+func (queues *queuesT) startShutdown() bool {
+	queues.mapsMutex.Lock()
+	defer queues.mapsMutex.Unlock()
+
+	if queues.stopping {
+		return false
+	}
+
+	queues.stopping = true
+
+	return true
+}
+
+// runningItems returns total number of items being processed by workers.
+func (queues *queuesT) runningItems() int {
+	running := 0
+
+	for _, queue := range queues.list() {
+		queue.mutex.Lock()
+		running += queue.running
+		queue.mutex.Unlock()
+	}
+
+	return running
+}
+
+// shutdown stops all queues from accepting and handing out items,
+// returns an error to all clients whose items are still waiting in
+// them, waits up to grace period for items already being processed by
+// workers to complete, and then terminates the frontend.
+func (queues *queuesT) shutdown() {
+	discarded := 0
+
+	for _, queue := range queues.list() {
+		queue.mutex.Lock()
+		queue.stopping = true
+		queue.releaseWaiters()
+		items := queue.items.clear()
+		queue.mutex.Unlock()
+
+		for _, item := range items {
+			errorReplyClose(item.client, errShutdown.Error())
+		}
+
+		discarded += len(items)
+	}
+
+	grace := queues.settings.grace
+	log.Printf("Shutting down: discarded %d queued requests, waiting up to %v for running ones", discarded, grace)
+
+	deadline := time.Now().Add(grace)
+
+	for {
+		running := queues.runningItems()
+		if running == 0 {
+			log.Print("All running items completed => terminating")
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			log.Printf("WARN: %d items still running after %v grace period => terminating", running, grace)
+			break
+		}
+
+		time.Sleep(shutdownPoll)
+	}
+
+	os.Exit(0)
+}
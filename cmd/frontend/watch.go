@@ -0,0 +1,149 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"k8s-device-scalability-tester/pkg/protocol"
+)
+
+// isGone returns true if item client has disconnected, or its
+// connection has been closed.
+func (item *queueItem) isGone() bool {
+	select {
+	case <-item.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchClient waits until given item client connection is closed,
+// either by client disconnecting, or frontend after replying to it, and
+// then closes item gone channel. If client disconnected while its item
+// was still in queue, item is removed from the queue.
+//
+// Clients do not send anything after their request, so read returns
+// only when connection gets closed, or client violates the protocol.
+func (queue *queueT) watchClient(item *queueItem) {
+	conn := item.client
+	buf := make([]byte, 1)
+
+	n, err := conn.Read(buf)
+	if n > 0 {
+		log.Printf("WARN: unexpected data from client '%s' after its request, dropping it", conn.RemoteAddr())
+	} else if verbose {
+		log.Printf("Client '%s' connection closed: %v", conn.RemoteAddr(), err)
+	}
+
+	close(item.gone)
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// item already taken from queue, normal completion
+	if !*item.queued {
+		return
+	}
+
+	for i := 0; i < queue.items.len(); i++ {
+		if queue.items.at(i).client != conn {
+			continue
+		}
+
+		removed := queue.items.remove(i)
+		queue.discardGone(&removed)
+
+		return
+	}
+}
+
+// discardGone closes connection of given item, already removed from
+// the queue, whose client has disconnected, and counts it as a client
+// disconnect. Must be called with queue.mutex held.
+func (queue *queueT) discardGone(item *queueItem) {
+	log.Printf("WARN: discarded request from disappeared client '%s'", item.client.RemoteAddr())
+	item.client.Close()
+	queue.disconnect++
+}
+
+// watchWorker watches given worker connection while worker waits for
+// an item. Returned channel is closed if connection gets closed, and
+// returned function stops watching, so that item can be sent to the
+// worker, and its reply read.
+//
+// Workers do not send anything while waiting for an item, so read
+// returns only when connection gets closed, watching is stopped (by
+// read deadline), or worker violates the protocol.
+func watchWorker(conn net.Conn) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 1)
+
+		n, err := conn.Read(buf)
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+
+		if n > 0 {
+			log.Printf("WARN: unexpected data from worker '%s' while it waits for item, dropping it", conn.RemoteAddr())
+		} else if verbose {
+			log.Printf("Worker '%s' connection closed: %v", conn.RemoteAddr(), err)
+		}
+
+		close(gone)
+	}()
+
+	return gone, func() {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			log.Printf("WARN: failed to set connection deadline: %v", err)
+		}
+
+		<-done
+	}
+}
+
+// readReply reads reply for given item from given worker, within given
+// lease. If item client disconnects before that, worker is asked to
+// cancel the item, and its (canceled) reply is read.
+func readReply(worker net.Conn, item *queueItem, lease time.Duration) ([]byte, error) {
+	type readResult struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan readResult, 1)
+
+	setDeadline(worker, lease, false)
+
+	go func() {
+		data, err := protocol.Read(worker, msgmax)
+		done <- readResult{data, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.data, result.err
+	case <-item.gone:
+	}
+
+	log.Printf("WARN: client '%s' disconnected while its item was running => canceling it on worker '%s'",
+		item.client.RemoteAddr(), worker.RemoteAddr())
+
+	if _, err := send(worker, protocol.NewCancel("client disconnected")); err != nil {
+		log.Printf("WARN: sending cancel request to worker '%s' failed: %v", worker.RemoteAddr(), err)
+	}
+
+	result := <-done
+
+	return result.data, result.err
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const workersURL = "/workers"
+
+// workerT is the registry information for a single worker.
+type workerT struct {
+	pod, node, queue string
+	labels           map[string]string
+	// when worker was last seen, and when it last changed busy state
+	seen, changed time.Time
+	// completed items
+	items uint64
+	// accumulated busy / idle times, excluding current state
+	busysecs, idlesecs float64
+	busy               bool
+}
+
+// workerInfoT is worker info provided by the listing endpoint.
+type workerInfoT struct {
+	Pod         string
+	Node        string
+	Queue       string
+	Labels      map[string]string
+	LastSeen    time.Time
+	Items       uint64
+	Busy        bool
+	BusySeconds float64
+	IdleSeconds float64
+}
+
+// registryT tracks the workers, based on their work requests and replies.
+type registryT struct {
+	workers map[string]*workerT
+	// workers not seen for this long are dropped, set at startup
+	expiry time.Duration
+	// locking for those
+	mutex sync.Mutex
+}
+
+// newRegistry returns worker registry with given expiry time.
+func newRegistry(expiry time.Duration) *registryT {
+	return &registryT{
+		workers: make(map[string]*workerT),
+		expiry:  expiry,
+	}
+}
+
+// workerID returns registry ID for worker with given pod name, work
+// slot and connection. Remote host is used for workers not providing
+// a pod name, and slot is appended to ID of multi-slot workers.
+func workerID(pod string, slot int, conn net.Conn) string {
+	if pod == "" {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+
+		pod = host
+	}
+
+	if slot > 0 {
+		return fmt.Sprintf("%s/%d", pod, slot)
+	}
+
+	return pod
+}
+
+// update updates state of given worker, adding it to registry if needed.
+// Must be called with registry mutex held.
+func (r *registryT) update(id, node, queue string, busy bool) *workerT {
+	now := time.Now()
+
+	w, exists := r.workers[id]
+	if !exists {
+		w = &workerT{pod: id, changed: now}
+		r.workers[id] = w
+	}
+
+	if node != "" {
+		w.node = node
+	}
+
+	w.queue = queue
+	w.seen = now
+
+	if w.busy != busy {
+		if w.busy {
+			w.busysecs += now.Sub(w.changed).Seconds()
+		} else {
+			w.idlesecs += now.Sub(w.changed).Seconds()
+		}
+
+		w.busy = busy
+		w.changed = now
+	}
+
+	return w
+}
+
+// pulled registers work request from given worker, with given labels.
+func (r *registryT) pulled(id, node, queue string, labels map[string]string) {
+	r.mutex.Lock()
+	r.update(id, node, queue, false).labels = labels
+	r.mutex.Unlock()
+}
+
+// started marks given worker busy with an item.
+func (r *registryT) started(id, node, queue string) {
+	r.mutex.Lock()
+	r.update(id, node, queue, true)
+	r.mutex.Unlock()
+}
+
+// finished marks given worker idle, and if item was completed,
+// increases its item count.
+func (r *registryT) finished(id, node, queue string, completed bool) {
+	r.mutex.Lock()
+
+	w := r.update(id, node, queue, false)
+	if completed {
+		w.items++
+	}
+
+	r.mutex.Unlock()
+}
+
+// list returns info for all registered workers, sorted by queue and pod,
+// after dropping expired ones.
+func (r *registryT) list() []workerInfoT {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	infos := make([]workerInfoT, 0, len(r.workers))
+
+	for id, w := range r.workers {
+		if !w.busy && r.expiry > 0 && now.Sub(w.seen) > r.expiry {
+			if verbose {
+				log.Printf("Dropping worker '%s', not seen since %v", id, w.seen)
+			}
+
+			delete(r.workers, id)
+
+			continue
+		}
+
+		info := workerInfoT{
+			Pod:         w.pod,
+			Node:        w.node,
+			Queue:       w.queue,
+			Labels:      w.labels,
+			LastSeen:    w.seen,
+			Items:       w.items,
+			Busy:        w.busy,
+			BusySeconds: w.busysecs,
+			IdleSeconds: w.idlesecs,
+		}
+
+		// add current state duration
+		if w.busy {
+			info.BusySeconds += now.Sub(w.changed).Seconds()
+		} else {
+			info.IdleSeconds += now.Sub(w.changed).Seconds()
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Queue != infos[j].Queue {
+			return infos[i].Queue < infos[j].Queue
+		}
+
+		return infos[i].Pod < infos[j].Pod
+	})
+
+	return infos
+}
+
+// export writes worker metrics.
+func (r *registryT) export(mw *metricWriter) {
+	infos := r.list()
+
+	labelsets := make([]string, len(infos))
+	for i := range infos {
+		labelsets[i] = labels("name", infos[i].Queue, "pod", infos[i].Pod, "node", infos[i].Node)
+	}
+
+	mw.family("hpa_worker_busy", gaugeType, "Whether worker is processing an item (1) or not (0).")
+
+	for i := range infos {
+		busy := uint64(0)
+		if infos[i].Busy {
+			busy = 1
+		}
+
+		mw.sample("hpa_worker_busy", labelsets[i], busy)
+	}
+
+	mw.family("hpa_worker_items_total", counterType, "Items completed by worker.")
+
+	for i := range infos {
+		mw.sample("hpa_worker_items_total", labelsets[i], infos[i].Items)
+	}
+
+	mw.family("hpa_worker_busy_seconds_total", counterType, "Time worker has spent processing items.")
+
+	for i := range infos {
+		mw.sampleFloat("hpa_worker_busy_seconds_total", labelsets[i], infos[i].BusySeconds)
+	}
+
+	mw.family("hpa_worker_idle_seconds_total", counterType, "Time worker has spent without an item.")
+
+	for i := range infos {
+		mw.sampleFloat("hpa_worker_idle_seconds_total", labelsets[i], infos[i].IdleSeconds)
+	}
+
+	mw.family("hpa_worker_last_seen_timestamp_seconds", gaugeType, "When worker was last seen, as Unix time.")
+
+	for i := range infos {
+		seen := float64(infos[i].LastSeen.UnixNano()) / float64(time.Second)
+		mw.sampleFloat("hpa_worker_last_seen_timestamp_seconds", labelsets[i], seen)
+	}
+
+	// per-queue worker utilization
+	busy := make(map[string]uint64)
+	all := make(map[string]uint64)
+	names := []string{}
+
+	for i := range infos {
+		name := infos[i].Queue
+		if _, exists := all[name]; !exists {
+			names = append(names, name)
+		}
+
+		all[name]++
+
+		if infos[i].Busy {
+			busy[name]++
+		}
+	}
+
+	mw.family("hpa_queue_workers", gaugeType, "Known (non-expired) workers for queue.")
+
+	for _, name := range names {
+		mw.sample("hpa_queue_workers", queueLabels(name), all[name])
+	}
+
+	mw.family("hpa_queue_worker_utilization", gaugeType, "Ratio of known queue workers currently processing an item.")
+
+	for _, name := range names {
+		mw.sampleFloat("hpa_queue_worker_utilization", queueLabels(name), float64(busy[name])/float64(all[name]))
+	}
+}
+
+// lister provides JSON listing of the registered workers.
+func (r *registryT) lister(w http.ResponseWriter, req *http.Request) {
+	if status := requestCheck(req, workersURL); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	if verbose {
+		log.Printf("workers query from '%s'", req.RemoteAddr)
+	}
+
+	data, err := json.MarshalIndent(r.list(), "", "\t")
+	if err != nil {
+		log.Printf("WARN: worker list JSON marshaling failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(data); err != nil {
+		log.Printf("WARN: worker list write failed: %v", err)
+	}
+}
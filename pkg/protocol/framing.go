@@ -0,0 +1,162 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+
+// Package protocol implements message framing used between scalability
+// tester client, frontend and backend components.
+//
+// Each message is a single line of JSON, terminated by a newline. JSON
+// marshaling escapes newlines within strings, so message content never
+// contains them. Every message includes protocol version, so that
+// peers using incompatible framing/messages can detect the mismatch.
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Version is increased on incompatible message changes.
+	Version = 1
+	// DefaultMaxSize is default max size for a single message, in bytes.
+	DefaultMaxSize = 64 * 1024
+	// MinMaxSize is smallest accepted message size limit, in bytes.
+	MinMaxSize = 256
+	// message delimiter.
+	delimiter = '\n'
+)
+
+var (
+	// ErrTooLarge is returned for messages exceeding given size limit.
+	ErrTooLarge = errors.New("message exceeds size limit")
+	// ErrUnterminated is returned for message missing its delimiter.
+	ErrUnterminated = errors.New("message is not newline terminated")
+	// ErrVersion is returned for message with incompatible protocol version.
+	ErrVersion = errors.New("protocol version mismatch")
+)
+
+// header is the part of the message common to all message types.
+type header struct {
+	Version int // protocol version
+}
+
+// Encode marshals given message to a newline terminated JSON line,
+// and checks that it fits to given size limit.
+func Encode(msg interface{}, maxsize int) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshaling failed: %w", err)
+	}
+
+	data = append(data, delimiter)
+	if len(data) > maxsize {
+		return nil, fmt.Errorf("%w (%d > %d bytes)", ErrTooLarge, len(data), maxsize)
+	}
+
+	return data, nil
+}
+
+// Send encodes given message and writes it to given writer.
+// Returns written data (for logging) and error.
+func Send(w io.Writer, msg interface{}, maxsize int) ([]byte, error) {
+	data, err := Encode(msg, maxsize)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := w.Write(data)
+	if err != nil {
+		return data, fmt.Errorf("write (%d/%d bytes) failed: %w", n, len(data), err)
+	}
+
+	return data, nil
+}
+
+// Decode checks given message line protocol version and unmarshals it
+// to given message struct.
+func Decode(data []byte, msg interface{}) error {
+	hdr := header{}
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return fmt.Errorf("JSON unmarshaling failed: %w", err)
+	}
+
+	if hdr.Version != Version {
+		return fmt.Errorf("%w (got %d, expected %d)", ErrVersion, hdr.Version, Version)
+	}
+
+	if err := json.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("JSON unmarshaling failed: %w", err)
+	}
+
+	return nil
+}
+
+// Reader reads successive messages from a connection. Its buffer may
+// contain data beyond the returned message, so all messages from the
+// connection need to be read with the same Reader.
+type Reader struct {
+	reader  *bufio.Reader
+	maxsize int
+}
+
+// NewReader returns Reader for messages of at most given size.
+func NewReader(r io.Reader, maxsize int) *Reader {
+	return &Reader{reader: bufio.NewReaderSize(r, maxsize), maxsize: maxsize}
+}
+
+// Read reads next newline terminated message line.
+func (r *Reader) Read() ([]byte, error) {
+	line, err := r.reader.ReadSlice(delimiter)
+	// line refers to reader buffer
+	data := append([]byte(nil), line...)
+
+	if err == nil {
+		return data, nil
+	}
+
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return data, fmt.Errorf("%w (%d bytes)", ErrTooLarge, r.maxsize)
+	}
+
+	if errors.Is(err, io.EOF) && len(data) > 0 {
+		return data, fmt.Errorf("%w (%d bytes)", ErrUnterminated, len(data))
+	}
+
+	return data, fmt.Errorf("read (%d bytes) failed: %w", len(data), err)
+}
+
+// Receive reads next message line and decodes it to given message
+// struct. Returns read data (for logging) and error.
+func (r *Reader) Receive(msg interface{}) ([]byte, error) {
+	data, err := r.Read()
+	if err != nil {
+		return data, err
+	}
+
+	return data, Decode(data, msg)
+}
+
+// Read reads a single newline terminated message line, of at most
+// given size, from given reader.
+//
+// Reading may consume data beyond the returned message, up to the size
+// limit, so it can be used only when peer does not send anything else
+// before receiving a reply. Otherwise use Reader.
+func Read(r io.Reader, maxsize int) ([]byte, error) {
+	return NewReader(r, maxsize).Read()
+}
+
+// Receive reads a single message line, of at most given size, from given
+// reader, and decodes it to given message struct. Returns read data
+// (for logging) and error. Same limitations apply as for Read.
+func Receive(r io.Reader, msg interface{}, maxsize int) ([]byte, error) {
+	data, err := Read(r, maxsize)
+	if err != nil {
+		return data, err
+	}
+
+	return data, Decode(data, msg)
+}
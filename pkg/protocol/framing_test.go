@@ -0,0 +1,126 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// message returns newline terminated version 1 message line padded
+// to given total size.
+func message(size int) string {
+	const (
+		prefix = `{"Version":1,"Queue":"`
+		suffix = "\"}\n"
+	)
+
+	return prefix + strings.Repeat("x", size-len(prefix)-len(suffix)) + suffix
+}
+
+func TestRead(t *testing.T) {
+	const maxsize = MinMaxSize
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		// specific error, or just failure
+		err  error
+		fail bool
+	}{
+		{"exact size", message(maxsize), message(maxsize), nil, false},
+		{"below size", message(maxsize - 1), message(maxsize - 1), nil, false},
+		{"oversize", message(maxsize + 1), "", ErrTooLarge, true},
+		{"unterminated", `{"Version":1}`, "", ErrUnterminated, true},
+		{"empty", "", "", nil, true},
+		{"only first", "{\"Version\":1}\n{\"Version\":1}\n", "{\"Version\":1}\n", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Read(strings.NewReader(tt.input), maxsize)
+
+			switch {
+			case tt.fail:
+				if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+					t.Fatalf("Read() error = %v, want failure %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("Read() unexpected error: %v", err)
+			case string(data) != tt.want:
+				t.Fatalf("Read() = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	const maxsize = MinMaxSize
+
+	input := message(maxsize) + "{\"Version\":1}\n" + message(maxsize+1)
+	reader := NewReader(strings.NewReader(input), maxsize)
+
+	for _, want := range []string{message(maxsize), "{\"Version\":1}\n"} {
+		data, err := reader.Read()
+		if err != nil || string(data) != want {
+			t.Fatalf("Read() = %q, %v, want %q", data, err, want)
+		}
+	}
+
+	if _, err := reader.Read(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Read() error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// specific error, or just failure
+		err  error
+		fail bool
+	}{
+		{"current version", `{"Version":1,"Queue":"q"}`, nil, false},
+		{"version 0", `{"Version":0,"Queue":"q"}`, ErrVersion, true},
+		{"missing version", `{"Queue":"q"}`, ErrVersion, true},
+		{"version 2", `{"Version":2,"Queue":"q"}`, ErrVersion, true},
+		{"invalid JSON", `{"Version":1,`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := ClientReq{}
+			err := Decode([]byte(tt.input), &req)
+
+			switch {
+			case tt.fail:
+				if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+					t.Fatalf("Decode() error = %v, want failure %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("Decode() unexpected error: %v", err)
+			case req.Queue != "q":
+				t.Fatalf("Decode() queue = %q, want %q", req.Queue, "q")
+			}
+		})
+	}
+}
+
+func TestEncodeSize(t *testing.T) {
+	req := NewClientReq(strings.Repeat("x", MinMaxSize), nil, 0, 0, nil)
+	if _, err := Encode(req, MinMaxSize); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Encode() error = %v, want %v", err, ErrTooLarge)
+	}
+
+	data, err := Encode(NewClientReq("q", nil, 0, 0, nil), MinMaxSize)
+	if err != nil {
+		t.Fatalf("Encode() unexpected error: %v", err)
+	}
+
+	got := ClientReq{}
+	if _, err = Receive(strings.NewReader(string(data)), &got, MinMaxSize); err != nil || got.Queue != "q" {
+		t.Fatalf("Receive() = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrLabel is returned for invalid worker labels.
+	ErrLabel = errors.New("invalid label")
+	// ErrSelector is returned for invalid label selector requirements.
+	ErrSelector = errors.New("invalid label selector requirement")
+)
+
+// label selector requirement operators, longer ones first,
+// so that they are matched before their prefixes.
+const (
+	opNotEqual  = "!="
+	opGreaterEq = ">="
+	opLessEq    = "<="
+	opEqual     = "="
+	opExists    = ""
+	opNotExists = "!"
+)
+
+// characters which are not allowed in label keys.
+const keyReserved = "=!<>, "
+
+// Requirement is a parsed label selector requirement.
+type Requirement struct {
+	Key   string
+	Op    string
+	Value string
+	// for numeric comparisons
+	number float64
+}
+
+// checkKey returns error if given label key is invalid.
+func checkKey(key string) error {
+	if key == "" || strings.ContainsAny(key, keyReserved) {
+		return fmt.Errorf("%w key '%s'", ErrLabel, key)
+	}
+
+	return nil
+}
+
+// CheckLabels returns error if given worker labels are invalid.
+func CheckLabels(labels map[string]string) error {
+	for key := range labels {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseLabels parses comma separated list of key=value worker labels.
+func ParseLabels(list string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	if list == "" {
+		return labels, nil
+	}
+
+	for _, field := range strings.Split(list, ",") {
+		key, value, found := strings.Cut(field, opEqual)
+		if !found {
+			return nil, fmt.Errorf("%w '%s' (not key=value)", ErrLabel, field)
+		}
+
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+
+		labels[key] = value
+	}
+
+	return labels, nil
+}
+
+// ParseRequirement parses given label selector requirement, which is
+// one of: "key=value", "key!=value", "key>=number", "key<=number",
+// "key" (label exists) or "!key" (label does not exist).
+func ParseRequirement(str string) (Requirement, error) {
+	if strings.HasPrefix(str, opNotExists) {
+		key := str[len(opNotExists):]
+		if err := checkKey(key); err != nil {
+			return Requirement{}, fmt.Errorf("%w '%s': %v", ErrSelector, str, err)
+		}
+
+		return Requirement{Key: key, Op: opNotExists}, nil
+	}
+
+	for _, op := range []string{opNotEqual, opGreaterEq, opLessEq, opEqual} {
+		key, value, found := strings.Cut(str, op)
+		if !found {
+			continue
+		}
+
+		if err := checkKey(key); err != nil {
+			return Requirement{}, fmt.Errorf("%w '%s': %v", ErrSelector, str, err)
+		}
+
+		req := Requirement{Key: key, Op: op, Value: value}
+
+		if op == opGreaterEq || op == opLessEq {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Requirement{}, fmt.Errorf("%w '%s': non-numeric value", ErrSelector, str)
+			}
+
+			req.number = number
+		}
+
+		return req, nil
+	}
+
+	if err := checkKey(str); err != nil {
+		return Requirement{}, fmt.Errorf("%w '%s': %v", ErrSelector, str, err)
+	}
+
+	return Requirement{Key: str, Op: opExists}, nil
+}
+
+// ParseSelector parses given label selector requirements.
+func ParseSelector(selector []string) ([]Requirement, error) {
+	reqs := make([]Requirement, 0, len(selector))
+
+	for _, str := range selector {
+		req, err := ParseRequirement(str)
+		if err != nil {
+			return nil, err
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+// Matches returns true if given labels fulfill the requirement.
+// Numeric comparisons fail for labels with non-numeric values.
+func (r *Requirement) Matches(labels map[string]string) bool {
+	value, exists := labels[r.Key]
+
+	switch r.Op {
+	case opExists:
+		return exists
+	case opNotExists:
+		return !exists
+	case opEqual:
+		return exists && value == r.Value
+	case opNotEqual:
+		return !exists || value != r.Value
+	}
+
+	if !exists {
+		return false
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+
+	if r.Op == opGreaterEq {
+		return number >= r.number
+	}
+
+	return number <= r.number
+}
+
+// MatchesAll returns true if given labels fulfill all the requirements.
+func MatchesAll(reqs []Requirement, labels map[string]string) bool {
+	for i := range reqs {
+		if !reqs[i].Matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Requirement
+		fail  bool
+	}{
+		{"gpu=i915", Requirement{Key: "gpu", Op: opEqual, Value: "i915"}, false},
+		{"gpu=", Requirement{Key: "gpu", Op: opEqual}, false},
+		{"gpu!=i915", Requirement{Key: "gpu", Op: opNotEqual, Value: "i915"}, false},
+		{"mem>=4", Requirement{Key: "mem", Op: opGreaterEq, Value: "4", number: 4}, false},
+		{"gpu>=0.5", Requirement{Key: "gpu", Op: opGreaterEq, Value: "0.5", number: 0.5}, false},
+		{"mem<=-1e3", Requirement{Key: "mem", Op: opLessEq, Value: "-1e3", number: -1000}, false},
+		{"gpu", Requirement{Key: "gpu", Op: opExists}, false},
+		{"!gpu", Requirement{Key: "gpu", Op: opNotExists}, false},
+		// value may contain operator characters
+		{"a=b=c", Requirement{Key: "a", Op: opEqual, Value: "b=c"}, false},
+		{"a!=b=c", Requirement{Key: "a", Op: opNotEqual, Value: "b=c"}, false},
+		// "!=" is matched before "=", which leaves invalid key
+		{"a=b!=c", Requirement{}, true},
+		{"!=x", Requirement{}, true},
+		{"=x", Requirement{}, true},
+		{"!", Requirement{}, true},
+		{"", Requirement{}, true},
+		{"!a=b", Requirement{}, true},
+		{"a b=c", Requirement{}, true},
+		{"mem>=lots", Requirement{}, true},
+		{"mem<=", Requirement{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseRequirement(tt.input)
+
+			switch {
+			case tt.fail:
+				if !errors.Is(err, ErrSelector) {
+					t.Fatalf("ParseRequirement(%q) = %+v, %v, want %v", tt.input, got, err, ErrSelector)
+				}
+			case err != nil:
+				t.Fatalf("ParseRequirement(%q) unexpected error: %v", tt.input, err)
+			case got != tt.want:
+				t.Fatalf("ParseRequirement(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]string{
+		"gpu":  "i915",
+		"mem":  "8",
+		"frac": "0.5",
+		"name": "big",
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"gpu=i915", true},
+		{"gpu=xe", false},
+		{"missing=", false},
+		{"gpu!=xe", true},
+		{"gpu!=i915", false},
+		{"missing!=i915", true},
+		{"mem>=8", true},
+		{"mem>=8.5", false},
+		{"frac>=0.5", true},
+		{"frac<=0.25", false},
+		{"mem<=16", true},
+		{"mem<=7", false},
+		{"missing>=0", false},
+		{"missing<=0", false},
+		// numeric comparisons fail for non-numeric values
+		{"name>=0", false},
+		{"name<=0", false},
+		{"gpu", true},
+		{"missing", false},
+		{"!gpu", false},
+		{"!missing", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			req, err := ParseRequirement(tt.selector)
+			if err != nil {
+				t.Fatalf("ParseRequirement(%q) unexpected error: %v", tt.selector, err)
+			}
+
+			if got := req.Matches(labels); got != tt.want {
+				t.Fatalf("%q Matches(%v) = %v, want %v", tt.selector, labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesAll(t *testing.T) {
+	labels := map[string]string{"gpu": "i915", "mem": "8"}
+
+	reqs, err := ParseSelector([]string{"gpu=i915", "mem>=4", "!xe"})
+	if err != nil {
+		t.Fatalf("ParseSelector() unexpected error: %v", err)
+	}
+
+	if !MatchesAll(reqs, labels) {
+		t.Fatalf("MatchesAll(%+v, %v) = false, want true", reqs, labels)
+	}
+
+	if MatchesAll(append(reqs, Requirement{Key: "mem", Op: opLessEq, number: 4}), labels) {
+		t.Fatal("MatchesAll() with failing requirement = true, want false")
+	}
+
+	if !MatchesAll(nil, labels) {
+		t.Fatal("MatchesAll() without requirements = false, want true")
+	}
+
+	if _, err = ParseSelector([]string{"gpu", "!=x"}); !errors.Is(err, ErrSelector) {
+		t.Fatalf("ParseSelector() error = %v, want %v", err, ErrSelector)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("gpu=i915,mem=8,empty=")
+	if err != nil {
+		t.Fatalf("ParseLabels() unexpected error: %v", err)
+	}
+
+	if len(labels) != 3 || labels["gpu"] != "i915" || labels["mem"] != "8" || labels["empty"] != "" {
+		t.Fatalf("ParseLabels() = %v", labels)
+	}
+
+	for _, list := range []string{"gpu", "=x", "a!b=c", "gpu=i915,"} {
+		if _, err = ParseLabels(list); !errors.Is(err, ErrLabel) {
+			t.Fatalf("ParseLabels(%q) error = %v, want %v", list, err, ErrLabel)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrQueue is returned for invalid queue names.
+	ErrQueue = errors.New("invalid queue name")
+	// ErrLimit is returned for invalid run-time limits.
+	ErrLimit = errors.New("invalid run-time limit")
+	// ErrWait is returned for invalid queue wait times.
+	ErrWait = errors.New("invalid queue wait time")
+	// ErrPriority is returned for out of range request priorities.
+	ErrPriority = errors.New("invalid request priority")
+	// ErrSlot is returned for invalid worker slot numbers.
+	ErrSlot = errors.New("invalid worker slot")
+)
+
+// MaxPriority is max absolute value for request priority.
+const MaxPriority = 9
+
+// ClientReq is client service request to frontend.
+type ClientReq struct {
+	Version  int      // protocol version
+	Queue    string   // queue name
+	Args     []string // extra workload arguments
+	Limit    float64  // workload run-time limit, in secs (0=default)
+	Priority int      // added to queue priority, higher is served first
+	Selector []string // worker label requirements, see ParseRequirement()
+}
+
+// WorkReq is worker work item request to frontend.
+type WorkReq struct {
+	Version int     // protocol version
+	Queue   string  // queue name
+	Pod     string  // worker pod name, if known
+	Node    string  // worker node name, if known
+	Slot    int     // work slot within worker pod (0=pod has just one)
+	Wait    float64 // max time to wait for item when queue is empty, in secs (0=no wait)
+	// worker capability labels, matched against client request selectors
+	Labels map[string]string
+}
+
+// WorkItem is frontend reply to worker, with work for it.
+type WorkItem struct {
+	Version int      // protocol version
+	Error   string   // non-empty on errors
+	ID      string   // item ID, unique within frontend run
+	Args    []string // extra workload arguments
+	Limit   float64  // in secs (0=default)
+	Empty   bool     // true if error is due to queue being empty
+}
+
+// Cancel is frontend request to worker to cancel its current work item.
+type Cancel struct {
+	Version int    // protocol version
+	Reason  string // why item was canceled
+}
+
+// Usage is workload resource usage, from rusage and /proc, including
+// its child processes which it has waited for.
+type Usage struct {
+	Utime      float64 // user CPU time, in secs
+	Stime      float64 // system CPU time, in secs
+	Maxrss     int64   // max resident set size, in KiB
+	Nvcsw      int64   // voluntary context switches
+	Nivcsw     int64   // involuntary context switches
+	ReadBytes  uint64  // bytes read with read syscalls
+	WriteBytes uint64  // bytes written with write syscalls
+	DiskRead   uint64  // bytes read from storage
+	DiskWrite  uint64  // bytes written to storage
+}
+
+// Reply is worker -> frontend -> client reply for the request.
+type Reply struct {
+	Version  int     // protocol version
+	Pod      string  // who did work
+	Node     string  // on which node
+	Device   string  // device mapped to worker, if any
+	Error    string  // non-empty on errors
+	Output   string  // workload output tail, for failed runs
+	Timeout  float64 // >0 = workload timed out
+	Canceled bool    // true if workload was canceled
+	Runtime  float64 // workload run time, in secs
+	Waittime float64 // queue wait time, in secs, added by frontend
+	Retcode  int     // workload return code
+	Usage    Usage   // workload resource usage (zero for builtin sleep)
+}
+
+// NewClientReq returns client request for given queue, with
+// given worker label selector.
+func NewClientReq(queue string, args []string, limit float64, priority int, selector []string) ClientReq {
+	return ClientReq{Version: Version, Queue: queue, Args: args, Limit: limit, Priority: priority, Selector: selector}
+}
+
+// NewWorkReq returns work request for given queue and wait time,
+// from worker slot on given pod and node, with given labels.
+func NewWorkReq(queue, pod, node string, slot int, wait float64, labels map[string]string) WorkReq {
+	return WorkReq{Version: Version, Queue: queue, Pod: pod, Node: node, Slot: slot, Wait: wait, Labels: labels}
+}
+
+// NewCancel returns cancel request with given reason.
+func NewCancel(reason string) Cancel {
+	return Cancel{Version: Version, Reason: reason}
+}
+
+// NewWorkItem returns work item with given ID, args and limit.
+func NewWorkItem(id string, args []string, limit float64) WorkItem {
+	return WorkItem{Version: Version, ID: id, Args: args, Limit: limit}
+}
+
+// NewErrorItem returns work item for given error.
+func NewErrorItem(empty bool, msg string) WorkItem {
+	return WorkItem{Version: Version, Error: msg, Empty: empty}
+}
+
+// NewErrorReply returns failure reply for given error.
+func NewErrorReply(msg string) Reply {
+	return Reply{Version: Version, Error: msg, Retcode: 1}
+}
+
+// checkLimit checks that run-time limit is non-negative.
+func checkLimit(limit float64) error {
+	if limit < 0.0 {
+		return fmt.Errorf("%w: %g", ErrLimit, limit)
+	}
+
+	return nil
+}
+
+// Validate checks client request content, except for its selector.
+// Selector is checked by parsing it with ParseSelector(), as its users
+// need the parsed result.
+func (r *ClientReq) Validate() error {
+	if r.Queue == "" {
+		return fmt.Errorf("%w ''", ErrQueue)
+	}
+
+	if r.Priority < -MaxPriority || r.Priority > MaxPriority {
+		return fmt.Errorf("%w %d (not within -%d - %d)", ErrPriority, r.Priority, MaxPriority, MaxPriority)
+	}
+
+	return checkLimit(r.Limit)
+}
+
+// Validate checks work request content.
+func (r *WorkReq) Validate() error {
+	if r.Queue == "" {
+		return fmt.Errorf("%w ''", ErrQueue)
+	}
+
+	if r.Wait < 0.0 {
+		return fmt.Errorf("%w: %g", ErrWait, r.Wait)
+	}
+
+	if r.Slot < 0 {
+		return fmt.Errorf("%w: %d", ErrSlot, r.Slot)
+	}
+
+	return CheckLabels(r.Labels)
+}
+
+// Validate checks work item content.
+func (i *WorkItem) Validate() error {
+	if i.Error != "" {
+		return nil
+	}
+
+	return checkLimit(i.Limit)
+}